@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Entries that haven't been refreshed for this long belong to lobbies that
+// went away without dequeuing, and are dropped so they don't block the queue.
+const queueEntryTimeout = 30 * time.Second
+
+type queueEntry struct {
+	matchId  string
+	lastSeen time.Time
+}
+
+// AllocationQueue is a FIFO of lobbies waiting for game server capacity. It is
+// shared by every lobby, so all access goes through mu.
+type AllocationQueue struct {
+	mu      sync.Mutex
+	entries []*queueEntry
+}
+
+func newAllocationQueue() *AllocationQueue {
+	return &AllocationQueue{}
+}
+
+// Enqueue adds the match to the back of the queue if it isn't already in it
+// and returns its zero-based position. Waiting lobbies call it every tick to
+// keep their place.
+func (q *AllocationQueue) Enqueue(matchId string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	q.prune(now)
+
+	for ix, e := range q.entries {
+		if e.matchId == matchId {
+			e.lastSeen = now
+			return ix
+		}
+	}
+
+	q.entries = append(q.entries, &queueEntry{matchId: matchId, lastSeen: now})
+	return len(q.entries) - 1
+}
+
+func (q *AllocationQueue) Remove(matchId string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for ix, e := range q.entries {
+		if e.matchId == matchId {
+			q.entries = append(q.entries[:ix], q.entries[ix+1:]...)
+			return
+		}
+	}
+}
+
+func (q *AllocationQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.entries)
+}
+
+func (q *AllocationQueue) prune(now time.Time) {
+	live := q.entries[:0]
+	for _, e := range q.entries {
+		if now.Sub(e.lastSeen) < queueEntryTimeout {
+			live = append(live, e)
+		}
+	}
+	q.entries = live
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+
+	"imps/mpserver/protocol"
+)
+
+const (
+	releaseAttempts     = 5
+	releaseInitialDelay = time.Second
+)
+
+var (
+	errNoServerManagers  = errors.New("no server managers configured")
+	errCapacityExhausted = errors.New("no game server capacity available")
+)
+
+// serverManagerConfig is a server manager to allocate game servers from. A
+// backend without a region will serve allocations for any region.
+type serverManagerConfig struct {
+	Address string `json:"address"`
+	Region  string `json:"region"`
+}
+
+type serverManagerBackend struct {
+	Address      string    `json:"address"`
+	Region       string    `json:"region"`
+	Healthy      bool      `json:"healthy"`
+	FreeCapacity int       `json:"freeCapacity"`
+	LastChecked  time.Time `json:"lastChecked"`
+	LastError    string    `json:"lastError"`
+}
+
+type serverManagerHealth struct {
+	FreeCapacity int `json:"freeCapacity"`
+}
+
+// gameServerAllocation is a game server handed out by one of the backends.
+// Response is the backend's reply, which is passed on to the players.
+type gameServerAllocation struct {
+	ServerId string
+	Backend  string
+	Response []byte
+}
+
+// ServerAllocator spreads game server allocations across a pool of server
+// managers. It is shared by every lobby, so all access goes through mu.
+type ServerAllocator struct {
+	mu       sync.Mutex
+	backends []*serverManagerBackend
+	client   *http.Client
+}
+
+func newServerAllocator(configs []serverManagerConfig) *ServerAllocator {
+	backends := make([]*serverManagerBackend, 0, len(configs))
+	for _, c := range configs {
+		backends = append(backends, &serverManagerBackend{
+			Address: c.Address,
+			Region:  c.Region,
+			// Assume a backend is usable until a probe says otherwise
+			Healthy: true,
+		})
+	}
+
+	return &ServerAllocator{
+		backends: backends,
+		client:   &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// StartHealthChecks probes every backend immediately and then once per
+// interval until ctx is cancelled.
+func (a *ServerAllocator) StartHealthChecks(ctx context.Context, logger runtime.Logger, interval time.Duration) {
+	a.checkHealth(logger)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				a.checkHealth(logger)
+			}
+		}
+	}()
+}
+
+func (a *ServerAllocator) checkHealth(logger runtime.Logger) {
+	a.mu.Lock()
+	addresses := make([]string, 0, len(a.backends))
+	for _, b := range a.backends {
+		addresses = append(addresses, b.Address)
+	}
+	a.mu.Unlock()
+
+	// Probe without holding the lock so a slow backend doesn't stall allocations
+	for _, address := range addresses {
+		health, err := a.probe(address)
+
+		a.mu.Lock()
+		b := a.backend(address)
+		wasHealthy := b.Healthy
+		b.LastChecked = time.Now()
+		if err != nil {
+			b.Healthy = false
+			b.LastError = err.Error()
+		} else {
+			b.Healthy = true
+			b.LastError = ""
+			b.FreeCapacity = health.FreeCapacity
+		}
+		a.mu.Unlock()
+
+		if wasHealthy && err != nil {
+			logger.Warn("server manager %s is unhealthy: %v", address, err)
+		} else if !wasHealthy && err == nil {
+			logger.Info("server manager %s is healthy again", address)
+		}
+	}
+}
+
+func (a *ServerAllocator) probe(address string) (*serverManagerHealth, error) {
+	resp, err := a.client.Get(address + "/Health")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("health check returned %s", resp.Status)
+	}
+
+	var health serverManagerHealth
+	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+		return nil, err
+	}
+	return &health, nil
+}
+
+func (a *ServerAllocator) backend(address string) *serverManagerBackend {
+	for _, b := range a.backends {
+		if b.Address == address {
+			return b
+		}
+	}
+	return nil
+}
+
+// candidates orders the backends to try for an allocation: healthy before
+// unhealthy, backends in the requested region before the rest, then by free
+// capacity. Unhealthy backends are still tried as a last resort since their
+// health may be stale.
+func (a *ServerAllocator) candidates(region string) []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	backends := make([]*serverManagerBackend, len(a.backends))
+	copy(backends, a.backends)
+
+	inRegion := func(b *serverManagerBackend) bool {
+		return b.Region == "" || b.Region == region
+	}
+	sort.SliceStable(backends, func(i, j int) bool {
+		bi, bj := backends[i], backends[j]
+		if bi.Healthy != bj.Healthy {
+			return bi.Healthy
+		}
+		if inRegion(bi) != inRegion(bj) {
+			return inRegion(bi)
+		}
+		return bi.FreeCapacity > bj.FreeCapacity
+	})
+
+	addresses := make([]string, 0, len(backends))
+	for _, b := range backends {
+		addresses = append(addresses, b.Address)
+	}
+	return addresses
+}
+
+// Allocate asks the pool for a game server for the given match, failing over
+// to the next backend whenever one of them can't be reached. The lobby's
+// settings are passed along so the server can set the game up.
+func (a *ServerAllocator) Allocate(matchId string, region string, settings protocol.LobbySettings) (*gameServerAllocation, error) {
+	jsonBytes, err := json.Marshal(map[string]interface{}{"matchId": matchId, "region": region, "settings": settings})
+	if err != nil {
+		return nil, err
+	}
+
+	lastErr := errNoServerManagers
+	exhausted := false
+	for _, address := range a.candidates(region) {
+		body, err := a.post(address, jsonBytes)
+
+		a.mu.Lock()
+		b := a.backend(address)
+		if errors.Is(err, errCapacityExhausted) {
+			// Full but reachable, so it stays healthy
+			b.FreeCapacity = 0
+			exhausted = true
+		} else if err != nil {
+			b.Healthy = false
+			b.LastError = err.Error()
+		} else if b.FreeCapacity > 0 {
+			// Account for the server we just took until the next probe
+			b.FreeCapacity--
+		}
+		a.mu.Unlock()
+
+		if err != nil {
+			lastErr = fmt.Errorf("allocating from %s: %w", address, err)
+			continue
+		}
+
+		var server struct {
+			ServerId string `json:"serverId"`
+		}
+		if err := json.Unmarshal(body, &server); err != nil {
+			return nil, fmt.Errorf("decoding allocation from %s: %w", address, err)
+		}
+
+		return &gameServerAllocation{
+			ServerId: server.ServerId,
+			Backend:  address,
+			Response: body,
+		}, nil
+	}
+
+	// Worth waiting for capacity as long as at least one backend is up
+	if exhausted {
+		return nil, errCapacityExhausted
+	}
+	return nil, lastErr
+}
+
+func (a *ServerAllocator) post(address string, jsonBytes []byte) ([]byte, error) {
+	resp, err := a.client.Post(address+"/GameServer", "application/json", bytes.NewBuffer(jsonBytes))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		return nil, errCapacityExhausted
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("server manager returned %s", resp.Status)
+	}
+
+	return body, nil
+}
+
+// serverManagerAllocation is a game server a backend believes is in use.
+type serverManagerAllocation struct {
+	ServerId  string    `json:"serverId"`
+	MatchId   string    `json:"matchId"`
+	CreatedAt time.Time `json:"createdAt"`
+	Backend   string    `json:"-"`
+}
+
+// ListAllocations collects the game servers every backend is holding. A
+// backend that can't be listed is skipped, since its servers will still be
+// there on the next pass.
+func (a *ServerAllocator) ListAllocations(logger runtime.Logger) []serverManagerAllocation {
+	a.mu.Lock()
+	addresses := make([]string, 0, len(a.backends))
+	for _, b := range a.backends {
+		addresses = append(addresses, b.Address)
+	}
+	a.mu.Unlock()
+
+	allocations := make([]serverManagerAllocation, 0)
+	for _, address := range addresses {
+		listed, err := a.list(address)
+		if err != nil {
+			logger.Warn("unable to list game servers on %s: %v", address, err)
+			continue
+		}
+
+		for _, allocation := range listed {
+			allocation.Backend = address
+			allocations = append(allocations, allocation)
+		}
+	}
+	return allocations
+}
+
+func (a *ServerAllocator) list(address string) ([]serverManagerAllocation, error) {
+	resp, err := a.client.Get(address + "/GameServer")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server manager returned %s", resp.Status)
+	}
+
+	var allocations []serverManagerAllocation
+	if err := json.NewDecoder(resp.Body).Decode(&allocations); err != nil {
+		return nil, err
+	}
+	return allocations, nil
+}
+
+// Release tells the backend that allocated a game server it can be shut down.
+// A server the backend no longer knows about counts as released.
+func (a *ServerAllocator) Release(backend string, serverId string) error {
+	req, err := http.NewRequest(http.MethodDelete, backend+"/GameServer/"+url.PathEscape(serverId), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("server manager returned %s", resp.Status)
+	}
+	return nil
+}
+
+// ReleaseInBackground releases a game server without blocking the caller,
+// backing off between attempts so a briefly unavailable backend doesn't leak
+// the server's port.
+func (a *ServerAllocator) ReleaseInBackground(logger runtime.Logger, backend string, serverId string) {
+	go func() {
+		delay := releaseInitialDelay
+		for attempt := 1; ; attempt++ {
+			err := a.Release(backend, serverId)
+			if err == nil {
+				logger.Info("released game server %s on %s", serverId, backend)
+				return
+			}
+			if attempt == releaseAttempts {
+				logger.Error("giving up releasing game server %s on %s: %v", serverId, backend, err)
+				return
+			}
+
+			logger.Warn("failed to release game server %s on %s, retrying in %v: %v", serverId, backend, delay, err)
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}()
+}
+
+// HasCapacity reports whether any healthy backend last said it had room for
+// another game server.
+func (a *ServerAllocator) HasCapacity() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, b := range a.backends {
+		if b.Healthy && b.FreeCapacity > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Status returns a copy of every backend's current state.
+func (a *ServerAllocator) Status() []serverManagerBackend {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	status := make([]serverManagerBackend, 0, len(a.backends))
+	for _, b := range a.backends {
+		status = append(status, *b)
+	}
+	return status
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/api"
+	"github.com/heroiclabs/nakama-common/runtime"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Lobbies report each step of their lifecycle as a Nakama event, which the
+// handler InitModule registers batches up and forwards to
+// LOBBY_ANALYTICS_SINK. Following a match ID through the events shows how far
+// each lobby got towards starting a game.
+const (
+	eventLobbyCreated    = "lobby_created"
+	eventPlayerJoined    = "lobby_player_joined"
+	eventPlayerLeft      = "lobby_player_left"
+	eventPlayerReadied   = "lobby_player_readied"
+	eventLaunchRequested = "lobby_launch_requested"
+	eventLaunched        = "lobby_launched"
+	eventLaunchFailed    = "lobby_launch_failed"
+	eventLobbyEnded      = "lobby_ended"
+
+	// Other events, such as ones sent by clients, aren't forwarded
+	analyticsEventPrefix = "lobby_"
+)
+
+// Why a lobby ended, as the reason property of lobby_ended
+const (
+	endReasonGameEnded = "game_ended"
+	endReasonEmpty     = "empty"
+	// The server shut down before the lobby launched
+	endReasonShutdown = "shutdown"
+)
+
+// lobby_launch_failed gives the allocation error as its reason, or this when
+// players stopped being ready while the lobby waited for a server
+const launchFailedUnready = "unready"
+
+// Batches waiting to be sent. Past this, batches are dropped rather than
+// holding up Nakama's event queue, except while the node is stopping, when
+// there is no later chance to send them and the queue waits for room for up
+// to analyticsDrainWait.
+const (
+	analyticsQueueLength = 16
+	analyticsDrainWait   = 5 * time.Second
+	// How often partial batches go out while the node is stopping
+	analyticsDrainInterval = 250 * time.Millisecond
+)
+
+// eventEmitter is the part of runtime.NakamaModule lobby events go through.
+type eventEmitter interface {
+	Event(ctx context.Context, evt *api.Event) error
+}
+
+// lobbyAnalytics emits lobby events, or does nothing when there is nowhere to
+// forward them to.
+type lobbyAnalytics struct {
+	events eventEmitter
+}
+
+func newLobbyAnalytics(events eventEmitter) *lobbyAnalytics {
+	return &lobbyAnalytics{events: events}
+}
+
+// emit sends the event with the properties every lobby event has: the match
+// ID the lobby was created with, its mode and region, and userId when the
+// event is about a player. Durations are in milliseconds.
+func (a *lobbyAnalytics) emit(logger runtime.Logger, name string, state *LobbyMatchState, userId string, took time.Duration, properties map[string]string) {
+	if a.events == nil {
+		return
+	}
+
+	all := lobbyTags(state)
+	all["match_id"] = state.OriginalMatchId
+	if userId != "" {
+		all["user_id"] = userId
+	}
+	if took > 0 {
+		all["duration_ms"] = strconv.FormatInt(took.Milliseconds(), 10)
+	}
+	for k, v := range properties {
+		all[k] = v
+	}
+
+	if err := a.events.Event(context.Background(), &api.Event{
+		Name:       name,
+		Properties: all,
+		Timestamp:  timestamppb.Now(),
+	}); err != nil {
+		logger.Warn("unable to emit %s for match %s: %v", name, state.MatchId, err)
+	}
+}
+
+// analyticsRecord is how an event is written to the sink.
+type analyticsRecord struct {
+	Name       string            `json:"name"`
+	Timestamp  time.Time         `json:"timestamp"`
+	Properties map[string]string `json:"properties"`
+}
+
+// analyticsSink is where batches of events end up.
+type analyticsSink interface {
+	send(ctx context.Context, records []analyticsRecord) error
+}
+
+// newAnalyticsSink reads LOBBY_ANALYTICS_SINK, either "file:" followed by a
+// path that events are appended to as JSON lines, or an http or https URL
+// that batches are posted to.
+func newAnalyticsSink(v string) (analyticsSink, error) {
+	switch {
+	case strings.HasPrefix(v, "file:"):
+		path := strings.TrimPrefix(v, "file:")
+		if path == "" {
+			return nil, fmt.Errorf("file sink needs a path")
+		}
+		return &fileSink{path: path}, nil
+	case strings.HasPrefix(v, "http://"), strings.HasPrefix(v, "https://"):
+		return &httpSink{url: v, client: &http.Client{Timeout: 10 * time.Second}}, nil
+	default:
+		return nil, fmt.Errorf("must be file:<path> or an http or https URL")
+	}
+}
+
+type fileSink struct {
+	path string
+}
+
+func (s *fileSink) send(ctx context.Context, records []analyticsRecord) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, r := range records {
+		if err := encoder.Encode(r); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// httpSink posts each batch as {"events": [...]}.
+type httpSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *httpSink) send(ctx context.Context, records []analyticsRecord) error {
+	body, err := json.Marshal(map[string]interface{}{"events": records})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s answered %s", s.url, resp.Status)
+	}
+	return nil
+}
+
+// analyticsForwarder batches lobby events for the sink. A batch goes out once
+// it is full or the flush interval passes, whichever is first, and sending
+// happens off Nakama's event queue so a slow sink can't back it up. Batches
+// the sink refuses are logged and dropped.
+type analyticsForwarder struct {
+	sink      analyticsSink
+	batchSize int
+
+	mu      sync.Mutex
+	pending []analyticsRecord
+	batches chan []analyticsRecord
+	// Set once the node is stopping, see Start
+	draining bool
+}
+
+func newAnalyticsForwarder(sink analyticsSink, batchSize int) *analyticsForwarder {
+	return &analyticsForwarder{
+		sink:      sink,
+		batchSize: batchSize,
+		pending:   make([]analyticsRecord, 0, batchSize),
+		batches:   make(chan []analyticsRecord, analyticsQueueLength),
+	}
+}
+
+// handle is the event handler InitModule registers.
+func (f *analyticsForwarder) handle(ctx context.Context, logger runtime.Logger, evt *api.Event) {
+	if !strings.HasPrefix(evt.GetName(), analyticsEventPrefix) {
+		return
+	}
+
+	f.mu.Lock()
+	f.pending = append(f.pending, analyticsRecord{
+		Name:       evt.GetName(),
+		Timestamp:  evt.GetTimestamp().AsTime(),
+		Properties: evt.GetProperties(),
+	})
+	full := len(f.pending) >= f.batchSize
+	draining := f.draining
+	f.mu.Unlock()
+
+	if !full {
+		return
+	}
+	batch := f.take()
+	if batch == nil {
+		return
+	}
+	if draining {
+		timer := time.NewTimer(analyticsDrainWait)
+		defer timer.Stop()
+		select {
+		case f.batches <- batch:
+		case <-timer.C:
+			logger.Warn("analytics sink didn't keep up with shutdown, dropping %d events", len(batch))
+		}
+		return
+	}
+	select {
+	case f.batches <- batch:
+	default:
+		logger.Warn("analytics sink is falling behind, dropping %d events", len(batch))
+	}
+}
+
+// take empties pending, returning what was in it, or nil if nothing was.
+func (f *analyticsForwarder) take() []analyticsRecord {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	batch := f.pending
+	if len(batch) == 0 {
+		return nil
+	}
+	f.pending = make([]analyticsRecord, 0, f.batchSize)
+	return batch
+}
+
+func (f *analyticsForwarder) send(logger runtime.Logger, batch []analyticsRecord) {
+	// Not the ctx Start was given, which is done by the time the last
+	// batches go out
+	if err := f.sink.send(context.Background(), batch); err != nil {
+		logger.Warn("unable to forward %d analytics events: %v", len(batch), err)
+	}
+}
+
+// Start sends batches as they fill up, and partial ones every interval.
+// ctx being done means the node is stopping: what is pending goes out
+// straight away, and partial batches go out every analyticsDrainInterval
+// from then on, since the lobby_ended events MatchTerminate leads to can't
+// wait for a flush the process may not be around for. Full batches wait for
+// room in the queue rather than being dropped.
+func (f *analyticsForwarder) Start(ctx context.Context, logger runtime.Logger, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		stopping := ctx.Done()
+		for {
+			select {
+			case <-stopping:
+				stopping = nil
+				f.mu.Lock()
+				f.draining = true
+				f.mu.Unlock()
+				ticker.Reset(analyticsDrainInterval)
+				if batch := f.take(); batch != nil {
+					f.send(logger, batch)
+				}
+			case <-ticker.C:
+				if batch := f.take(); batch != nil {
+					f.send(logger, batch)
+				}
+			case batch := <-f.batches:
+				f.send(logger, batch)
+			}
+		}
+	}()
+}
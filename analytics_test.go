@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/api"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"imps/mpserver/nakamatest"
+	"imps/mpserver/protocol"
+)
+
+func TestLobbyAnalytics(t *testing.T) {
+	h, host, _ := launchedLobby(t)
+	h.leave(host)
+	h.signal(signalGameEnded)
+	h.loop()
+
+	names := make([]string, 0)
+	for _, evt := range h.nk.Events {
+		names = append(names, evt.Name)
+	}
+	want := []string{
+		eventLobbyCreated,
+		eventPlayerJoined, eventPlayerJoined,
+		eventPlayerReadied, eventPlayerReadied,
+		eventLaunchRequested, eventLaunched,
+		eventPlayerLeft,
+		eventLobbyEnded,
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("events = %v, want %v", names, want)
+	}
+
+	region := h.nk.Events[6].Properties["region"]
+	for _, evt := range h.nk.Events {
+		if evt.Properties["match_id"] != "lobby.node" || evt.Properties["mode"] != "deathmatch" || evt.Timestamp == nil {
+			t.Errorf("%s has properties %v", evt.Name, evt.Properties)
+		}
+	}
+	if joined := h.nk.Events[1].Properties; joined["user_id"] != "host" || joined["region"] != regionNone {
+		t.Errorf("joined has properties %v", joined)
+	}
+	if region == regionNone {
+		t.Errorf("launched lobby has no region")
+	}
+	if ended := h.nk.Events[8].Properties; ended["reason"] != endReasonGameEnded || ended["region"] != region || ended["duration_ms"] == "" {
+		t.Errorf("ended has properties %v", ended)
+	}
+}
+
+func TestLobbyAnalyticsShutdown(t *testing.T) {
+	ended := func(h *lobbyHarness) []map[string]string {
+		properties := make([]map[string]string, 0)
+		for _, evt := range h.nk.Events {
+			if evt.Name == eventLobbyEnded {
+				properties = append(properties, evt.Properties)
+			}
+		}
+		return properties
+	}
+
+	t.Run("waiting lobby ends", func(t *testing.T) {
+		h := newLobbyHarness(t, nil)
+		h.init("host", protocol.LobbySettings{})
+		host := h.nk.AddUser("host", "Host")
+		h.join(host, deltaClient)
+		h.loop()
+
+		h.terminate(30)
+		h.loop()
+		if got := ended(h); len(got) != 1 || got[0]["reason"] != endReasonShutdown {
+			t.Fatalf("lobby_ended after shutdown = %v", got)
+		}
+		for key, n := range h.nk.Gauges {
+			if n != 0 {
+				t.Errorf("gauge %s = %v after shutdown", key, n)
+			}
+		}
+
+		// Emptying out during the grace period doesn't end it a second time
+		h.leave(host)
+		for h.state != nil {
+			h.loop()
+		}
+		if got := ended(h); len(got) != 1 {
+			t.Errorf("lobby_ended reported %d times", len(got))
+		}
+	})
+
+	t.Run("game in progress resumes", func(t *testing.T) {
+		h, _, _ := launchedLobby(t)
+		h.terminate(30)
+		h.loop()
+		if got := ended(h); len(got) != 0 {
+			t.Errorf("resuming lobby reported lobby_ended %v", got)
+		}
+		tags := map[string]string{"state": "in_progress", "mode": "deathmatch", "region": h.lobby().Region}
+		if n := gauge(h, metricLobbies, tags); n != 1 {
+			t.Errorf("lobbies in progress = %v", n)
+		}
+	})
+}
+
+func TestLobbyAnalyticsDisabled(t *testing.T) {
+	h := newLobbyHarness(t, nil)
+	h.match.(*LobbyMatch).analytics = newLobbyAnalytics(nil)
+	h.init("host", protocol.LobbySettings{})
+	h.join(h.nk.AddUser("host", "Host"), deltaClient)
+
+	if len(h.nk.Events) != 0 {
+		t.Errorf("emitted %d events with nowhere to send them", len(h.nk.Events))
+	}
+}
+
+func analyticsEvent(name string, matchId string) *api.Event {
+	return &api.Event{
+		Name:       name,
+		Properties: map[string]string{"match_id": matchId},
+		Timestamp:  timestamppb.New(time.Unix(1700000000, 0)),
+	}
+}
+
+func TestAnalyticsFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	sink, err := newAnalyticsSink("file:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logger := nakamatest.NewLogger(t)
+	forwarder := newAnalyticsForwarder(sink, 2)
+	forwarder.Start(ctx, logger, 50*time.Millisecond)
+
+	forwarder.handle(ctx, logger, analyticsEvent(eventLobbyCreated, "a"))
+	forwarder.handle(ctx, logger, &api.Event{Name: "client_opened_menu"})
+	forwarder.handle(ctx, logger, analyticsEvent(eventPlayerJoined, "a"))
+	// Not a full batch, so it waits for the flush interval
+	forwarder.handle(ctx, logger, analyticsEvent(eventLobbyCreated, "b"))
+
+	var records []analyticsRecord
+	for deadline := time.Now().Add(5 * time.Second); len(records) < 3 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		records = readAnalyticsFile(t, path)
+	}
+	if len(records) != 3 {
+		t.Fatalf("file has %d events, want 3", len(records))
+	}
+	if records[0].Name != eventLobbyCreated || records[1].Name != eventPlayerJoined || records[2].Properties["match_id"] != "b" {
+		t.Errorf("file has %+v", records)
+	}
+	if !records[0].Timestamp.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("timestamp = %v", records[0].Timestamp)
+	}
+}
+
+func readAnalyticsFile(t *testing.T, path string) []analyticsRecord {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	records := make([]analyticsRecord, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var r analyticsRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("bad line %q: %v", scanner.Text(), err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestAnalyticsHTTPSink(t *testing.T) {
+	batches := make(chan []analyticsRecord, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Events []analyticsRecord `json:"events"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		batches <- body.Events
+	}))
+	defer server.Close()
+
+	sink, err := newAnalyticsSink(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logger := nakamatest.NewLogger(t)
+	forwarder := newAnalyticsForwarder(sink, 2)
+	forwarder.Start(ctx, logger, time.Hour)
+
+	forwarder.handle(ctx, logger, analyticsEvent(eventLaunched, "a"))
+	forwarder.handle(ctx, logger, analyticsEvent(eventLobbyEnded, "a"))
+
+	select {
+	case batch := <-batches:
+		if len(batch) != 2 || batch[0].Name != eventLaunched || batch[1].Name != eventLobbyEnded {
+			t.Errorf("posted %+v", batch)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("full batch wasn't posted")
+	}
+}
+
+// Once the node is stopping, partial batches don't wait for the flush
+// interval, and full ones wait for the sink rather than being dropped.
+func TestAnalyticsForwarderDrains(t *testing.T) {
+	tests := []struct {
+		name      string
+		batchSize int
+		events    int
+		sendTakes time.Duration
+	}{
+		{name: "partial batch", batchSize: 10, events: 2},
+		{name: "more batches than the queue holds", batchSize: 2, events: 2 * (analyticsQueueLength + 4), sendTakes: 20 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &recordingSink{delay: tt.sendTakes}
+			stopping, stop := context.WithCancel(context.Background())
+			defer stop()
+			logger := nakamatest.NewLogger(t)
+			forwarder := newAnalyticsForwarder(sink, tt.batchSize)
+			forwarder.Start(stopping, logger, time.Hour)
+
+			forwarder.handle(stopping, logger, analyticsEvent(eventLobbyCreated, "a"))
+			stop()
+			for deadline := time.Now().Add(5 * time.Second); !forwarder.isDraining() && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			}
+			// Every lobby ends at once as the node stops
+			for i := 1; i < tt.events; i++ {
+				forwarder.handle(stopping, logger, analyticsEvent(eventLobbyEnded, fmt.Sprint(i)))
+			}
+
+			for deadline := time.Now().Add(10 * time.Second); len(sink.sent()) < tt.events && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			}
+			sent := sink.sent()
+			if len(sent) != tt.events {
+				t.Fatalf("sent %d of %d events", len(sent), tt.events)
+			}
+			// Batches may go out in any order, so only check none are missing
+			seen := make(map[string]bool)
+			for _, r := range sent {
+				seen[r.Properties["match_id"]] = true
+			}
+			for i := 1; i < tt.events; i++ {
+				if !seen[fmt.Sprint(i)] {
+					t.Errorf("lobby_ended for %d wasn't sent", i)
+				}
+			}
+		})
+	}
+}
+
+func (f *analyticsForwarder) isDraining() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.draining
+}
+
+// recordingSink keeps what it is sent, taking delay over each batch.
+type recordingSink struct {
+	delay time.Duration
+
+	mu      sync.Mutex
+	records []analyticsRecord
+}
+
+func (s *recordingSink) send(ctx context.Context, records []analyticsRecord) error {
+	time.Sleep(s.delay)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, records...)
+	return nil
+}
+
+func (s *recordingSink) sent() []analyticsRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]analyticsRecord(nil), s.records...)
+}
+
+func TestAnalyticsSinkConfig(t *testing.T) {
+	for _, v := range []string{"file:", "ftp://events", "events.jsonl"} {
+		if _, err := loadLobbyConfig(map[string]string{envAnalyticsSink: v}); err == nil {
+			t.Errorf("%s=%q was accepted", envAnalyticsSink, v)
+		}
+	}
+}
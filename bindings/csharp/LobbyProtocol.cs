@@ -0,0 +1,246 @@
+// Code generated by bindgen from imps/mpserver/protocol. DO NOT EDIT.
+
+using System.Collections.Generic;
+using Newtonsoft.Json;
+using Newtonsoft.Json.Linq;
+
+namespace Imps.Lobby.Protocol
+{
+    public static class LobbyProtocol
+    {
+        public const int Version = 2;
+        public const int MinVersion = 1;
+        public const int DeltaVersion = 2;
+        public const string VersionMetadataKey = "protocolVersion";
+        public const string EncodingMetadataKey = "encoding";
+        public const string EncodingJSON = "json";
+        public const string EncodingProtobuf = "protobuf";
+    }
+
+    public static class OpCodes
+    {
+        public const long OP_READY = 1;
+        public const long OP_LOBBY_UPDATE = 2;
+        public const long OP_GAME_START = 3;
+        public const long OP_REGION_LATENCY = 4;
+        public const long OP_QUEUE_POSITION = 5;
+        public const long OP_ERROR = 6;
+        public const long OP_LOBBY_DELTA = 7;
+        public const long OP_RESYNC_REQUEST = 8;
+        public const long OP_CHAT_SEND = 9;
+        public const long OP_CHAT_MESSAGE = 10;
+        public const long OP_CHAT_HISTORY = 11;
+        public const long OP_CHAT_MUTE = 12;
+        public const long OP_LOBBY_SETTINGS = 13;
+        public const long OP_SERVER_SHUTDOWN = 14;
+        public const long OP_MAINTENANCE = 15;
+    }
+
+    public static class ErrorCodes
+    {
+        public const string UnknownPlayer = "unknown_player";
+        public const string BadMessage = "bad_message";
+        public const string LaunchFailed = "launch_failed";
+        public const string LobbyClosed = "lobby_closed";
+        public const string RateLimited = "rate_limited";
+        public const string Muted = "muted";
+        public const string NotHost = "not_host";
+        public const string SettingsLocked = "settings_locked";
+    }
+
+    public static class LobbyEvents
+    {
+        public const string Joined = "joined";
+        public const string Left = "left";
+        public const string Readied = "readied";
+        public const string Moved = "moved";
+    }
+
+    public class Ready
+    {
+    }
+
+    public class RegionLatency
+    {
+        [JsonProperty("latencies")]
+        public Dictionary<string, int> Latencies { get; set; }
+    }
+
+    public class ResyncRequest
+    {
+    }
+
+    public class ChatSend
+    {
+        [JsonProperty("text")]
+        public string Text { get; set; }
+    }
+
+    public class ChatMute
+    {
+        [JsonProperty("userId")]
+        public string UserId { get; set; }
+        [JsonProperty("muted")]
+        public bool Muted { get; set; }
+    }
+
+    public class LobbySettings
+    {
+        [JsonProperty("mode")]
+        public string Mode { get; set; }
+        [JsonProperty("map")]
+        public string Map { get; set; }
+        [JsonProperty("timeLimit")]
+        public int TimeLimit { get; set; }
+        [JsonProperty("rules")]
+        public Dictionary<string, string> Rules { get; set; }
+    }
+
+    public class PlayerReady
+    {
+        [JsonProperty("version")]
+        public int Version { get; set; }
+        [JsonProperty("sessionId")]
+        public string SessionId { get; set; }
+    }
+
+    public class LobbyUpdate
+    {
+        [JsonProperty("version")]
+        public int Version { get; set; }
+        [JsonProperty("sequence")]
+        public long Sequence { get; set; }
+        [JsonProperty("players")]
+        public List<LobbyPlayer> Players { get; set; }
+        [JsonProperty("hostUserId")]
+        public string HostUserId { get; set; }
+        [JsonProperty("settings")]
+        public LobbySettings Settings { get; set; }
+    }
+
+    public class LobbyDelta
+    {
+        [JsonProperty("version")]
+        public int Version { get; set; }
+        [JsonProperty("sequence")]
+        public long Sequence { get; set; }
+        [JsonProperty("event")]
+        public string Event { get; set; }
+        [JsonProperty("player")]
+        public LobbyPlayer Player { get; set; }
+    }
+
+    public class LobbyPlayer
+    {
+        [JsonProperty("sessionId")]
+        public string SessionId { get; set; }
+        [JsonProperty("userId")]
+        public string UserId { get; set; }
+        [JsonProperty("displayName")]
+        public string DisplayName { get; set; }
+        [JsonProperty("isReady")]
+        public bool IsReady { get; set; }
+        [JsonProperty("isObserving")]
+        public bool IsObserving { get; set; }
+        [JsonProperty("slotNumber")]
+        public int SlotNumber { get; set; }
+    }
+
+    public class GameStart
+    {
+        [JsonProperty("version")]
+        public int Version { get; set; }
+        [JsonProperty("region")]
+        public string Region { get; set; }
+        [JsonProperty("server")]
+        public JToken Server { get; set; }
+    }
+
+    public class ChatMessage
+    {
+        [JsonProperty("version")]
+        public int Version { get; set; }
+        [JsonProperty("userId")]
+        public string UserId { get; set; }
+        [JsonProperty("displayName")]
+        public string DisplayName { get; set; }
+        [JsonProperty("text")]
+        public string Text { get; set; }
+        [JsonProperty("sentAt")]
+        public long SentAt { get; set; }
+    }
+
+    public class ChatHistory
+    {
+        [JsonProperty("version")]
+        public int Version { get; set; }
+        [JsonProperty("messages")]
+        public List<ChatMessage> Messages { get; set; }
+    }
+
+    public class QueuePosition
+    {
+        [JsonProperty("version")]
+        public int Version { get; set; }
+        [JsonProperty("position")]
+        public int Position { get; set; }
+    }
+
+    public class ServerShutdown
+    {
+        [JsonProperty("version")]
+        public int Version { get; set; }
+        [JsonProperty("graceSeconds")]
+        public int GraceSeconds { get; set; }
+        [JsonProperty("resumes")]
+        public bool Resumes { get; set; }
+    }
+
+    public class Maintenance
+    {
+        [JsonProperty("version")]
+        public int Version { get; set; }
+        [JsonProperty("active")]
+        public bool Active { get; set; }
+        [JsonProperty("message")]
+        public string Message { get; set; }
+        [JsonProperty("startsInSeconds")]
+        public int StartsInSeconds { get; set; }
+    }
+
+    public class ErrorMessage
+    {
+        [JsonProperty("version")]
+        public int Version { get; set; }
+        [JsonProperty("code")]
+        public string Code { get; set; }
+        [JsonProperty("message")]
+        public string Message { get; set; }
+    }
+
+    public class LobbyLabel
+    {
+        [JsonProperty("version")]
+        public int Version { get; set; }
+        [JsonProperty("isPrivate")]
+        public string IsPrivate { get; set; }
+        [JsonProperty("playerCount")]
+        public int PlayerCount { get; set; }
+        [JsonProperty("matchName")]
+        public string MatchName { get; set; }
+        [JsonProperty("canJoin")]
+        public string CanJoin { get; set; }
+        [JsonProperty("openSlots")]
+        public int OpenSlots { get; set; }
+        [JsonProperty("region")]
+        public string Region { get; set; }
+        [JsonProperty("mode")]
+        public string Mode { get; set; }
+        [JsonProperty("map")]
+        public string Map { get; set; }
+        [JsonProperty("timeLimit")]
+        public int TimeLimit { get; set; }
+        [JsonProperty("ranked")]
+        public string Ranked { get; set; }
+    }
+}
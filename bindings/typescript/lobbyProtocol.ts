@@ -0,0 +1,153 @@
+// Code generated by bindgen from imps/mpserver/protocol. DO NOT EDIT.
+
+export const PROTOCOL_VERSION = 2;
+export const PROTOCOL_MIN_VERSION = 1;
+export const PROTOCOL_DELTA_VERSION = 2;
+export const PROTOCOL_VERSION_METADATA_KEY = "protocolVersion";
+export const PROTOCOL_ENCODING_METADATA_KEY = "encoding";
+export const PROTOCOL_ENCODING_JSON = "json";
+export const PROTOCOL_ENCODING_PROTOBUF = "protobuf";
+
+export const OP_READY = 1;
+export const OP_LOBBY_UPDATE = 2;
+export const OP_GAME_START = 3;
+export const OP_REGION_LATENCY = 4;
+export const OP_QUEUE_POSITION = 5;
+export const OP_ERROR = 6;
+export const OP_LOBBY_DELTA = 7;
+export const OP_RESYNC_REQUEST = 8;
+export const OP_CHAT_SEND = 9;
+export const OP_CHAT_MESSAGE = 10;
+export const OP_CHAT_HISTORY = 11;
+export const OP_CHAT_MUTE = 12;
+export const OP_LOBBY_SETTINGS = 13;
+export const OP_SERVER_SHUTDOWN = 14;
+export const OP_MAINTENANCE = 15;
+
+export const ErrorCodes = {
+  UnknownPlayer: "unknown_player",
+  BadMessage: "bad_message",
+  LaunchFailed: "launch_failed",
+  LobbyClosed: "lobby_closed",
+  RateLimited: "rate_limited",
+  Muted: "muted",
+  NotHost: "not_host",
+  SettingsLocked: "settings_locked",
+} as const;
+
+export const LobbyEvents = {
+  Joined: "joined",
+  Left: "left",
+  Readied: "readied",
+  Moved: "moved",
+} as const;
+
+export type Ready = Record<string, never>;
+
+export interface RegionLatency {
+  latencies: Record<string, number>;
+}
+
+export type ResyncRequest = Record<string, never>;
+
+export interface ChatSend {
+  text: string;
+}
+
+export interface ChatMute {
+  userId: string;
+  muted: boolean;
+}
+
+export interface LobbySettings {
+  mode: string;
+  map: string;
+  timeLimit: number;
+  rules: Record<string, string>;
+}
+
+export interface PlayerReady {
+  version: number;
+  sessionId: string;
+}
+
+export interface LobbyUpdate {
+  version: number;
+  sequence: number;
+  players: LobbyPlayer[];
+  hostUserId: string;
+  settings: LobbySettings;
+}
+
+export interface LobbyDelta {
+  version: number;
+  sequence: number;
+  event: string;
+  player: LobbyPlayer;
+}
+
+export interface LobbyPlayer {
+  sessionId: string;
+  userId: string;
+  displayName: string;
+  isReady: boolean;
+  isObserving: boolean;
+  slotNumber: number;
+}
+
+export interface GameStart {
+  version: number;
+  region: string;
+  server: unknown;
+}
+
+export interface ChatMessage {
+  version: number;
+  userId: string;
+  displayName: string;
+  text: string;
+  sentAt: number;
+}
+
+export interface ChatHistory {
+  version: number;
+  messages: ChatMessage[];
+}
+
+export interface QueuePosition {
+  version: number;
+  position: number;
+}
+
+export interface ServerShutdown {
+  version: number;
+  graceSeconds: number;
+  resumes: boolean;
+}
+
+export interface Maintenance {
+  version: number;
+  active: boolean;
+  message: string;
+  startsInSeconds: number;
+}
+
+export interface ErrorMessage {
+  version: number;
+  code: string;
+  message: string;
+}
+
+export interface LobbyLabel {
+  version: number;
+  isPrivate: string;
+  playerCount: number;
+  matchName: string;
+  canJoin: string;
+  openSlots: number;
+  region: string;
+  mode: string;
+  map: string;
+  timeLimit: number;
+  ranked: string;
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+
+	"imps/mpserver/protocol"
+)
+
+const maxChatLength = 200
+const chatHistoryLength = 50
+
+// Nakama's friend state for a user the player has blocked
+const friendStateBlocked = 3
+
+const maxBlockedUsers = 1000
+
+// newWordFilter builds a pattern matching any of the words as a whole word,
+// regardless of case. It returns nil when there is nothing to filter.
+func newWordFilter(words []string) *regexp.Regexp {
+	quoted := make([]string, 0, len(words))
+	for _, word := range words {
+		if word != "" {
+			quoted = append(quoted, regexp.QuoteMeta(word))
+		}
+	}
+	if len(quoted) == 0 {
+		return nil
+	}
+	return regexp.MustCompile(`(?i)\b(` + strings.Join(quoted, "|") + `)\b`)
+}
+
+// filterChat masks every filtered word in text.
+func filterChat(text string, filter *regexp.Regexp) string {
+	if filter == nil {
+		return text
+	}
+	return filter.ReplaceAllStringFunc(text, func(match string) string {
+		return strings.Repeat("*", utf8.RuneCountInString(match))
+	})
+}
+
+// loadBlockedUsers looks up who the player has blocked, so their chat can be
+// hidden from them. A failed lookup just means nobody is hidden.
+func loadBlockedUsers(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, userId string) map[string]bool {
+	blocked := make(map[string]bool)
+
+	state := friendStateBlocked
+	friends, _, err := nk.FriendsList(ctx, userId, maxBlockedUsers, &state, "")
+	if err != nil {
+		logger.Warn("unable to load block list for %s: %v", userId, err)
+		return blocked
+	}
+
+	for _, f := range friends {
+		if f.GetUser() != nil {
+			blocked[f.GetUser().GetId()] = true
+		}
+	}
+	return blocked
+}
+
+// chatRecipients are the joined players who haven't blocked the sender.
+func chatRecipients(state *LobbyMatchState, senderUserId string) []runtime.Presence {
+	recipients := make([]runtime.Presence, 0, len(state.Players))
+	for _, p := range joinedPlayers(state) {
+		if !p.BlockedUserIds[senderUserId] {
+			recipients = append(recipients, p.Presence)
+		}
+	}
+	return recipients
+}
+
+// sendChatHistory catches a newly joined player up on recent chat, leaving
+// out anyone they've blocked.
+func sendChatHistory(logger runtime.Logger, state *LobbyMatchState, dispatcher runtime.MatchDispatcher, player *PlayerState) {
+	messages := make([]protocol.ChatMessage, 0, len(state.ChatHistory))
+	for _, message := range state.ChatHistory {
+		if !player.BlockedUserIds[message.UserId] {
+			messages = append(messages, message)
+		}
+	}
+
+	history := protocol.ChatHistory{
+		Version:  protocol.Version,
+		Messages: messages,
+	}
+	send(logger, state, dispatcher, protocol.OP_CHAT_HISTORY, history, []runtime.Presence{player.Presence})
+}
+
+func handleChatSend(logger runtime.Logger, state *LobbyMatchState, dispatcher runtime.MatchDispatcher, player *PlayerState, message runtime.MatchData, filter *regexp.Regexp) {
+	var chat protocol.ChatSend
+	if err := decodeMessage(player, message.GetData(), &chat); err != nil {
+		logger.Warn("ignoring malformed chat from %s: %v", message.GetUserId(), err)
+		sendError(logger, state, dispatcher, []runtime.Presence{message}, protocol.ErrorCodeBadMessage, err.Error())
+		return
+	}
+
+	text := strings.TrimSpace(chat.Text)
+	if text == "" || utf8.RuneCountInString(text) > maxChatLength {
+		err := &validationError{fieldErrors{fmt.Sprintf("text: must be between 1 and %d characters", maxChatLength)}}
+		sendError(logger, state, dispatcher, []runtime.Presence{message}, protocol.ErrorCodeBadMessage, err.Error())
+		return
+	}
+
+	if state.MutedUserIds[player.UserId] {
+		sendError(logger, state, dispatcher, []runtime.Presence{message}, protocol.ErrorCodeMuted, "The host has muted you")
+		return
+	}
+
+	relayed := protocol.ChatMessage{
+		Version:     protocol.Version,
+		UserId:      player.UserId,
+		DisplayName: player.DisplayName,
+		Text:        filterChat(text, filter),
+		SentAt:      message.GetReceiveTime(),
+	}
+
+	state.ChatHistory = append(state.ChatHistory, relayed)
+	if len(state.ChatHistory) > chatHistoryLength {
+		state.ChatHistory = state.ChatHistory[len(state.ChatHistory)-chatHistoryLength:]
+	}
+
+	send(logger, state, dispatcher, protocol.OP_CHAT_MESSAGE, relayed, chatRecipients(state, player.UserId))
+}
+
+func handleChatMute(logger runtime.Logger, state *LobbyMatchState, dispatcher runtime.MatchDispatcher, player *PlayerState, message runtime.MatchData) {
+	var mute protocol.ChatMute
+	if err := decodeMessage(player, message.GetData(), &mute); err != nil {
+		logger.Warn("ignoring malformed mute from %s: %v", message.GetUserId(), err)
+		sendError(logger, state, dispatcher, []runtime.Presence{message}, protocol.ErrorCodeBadMessage, err.Error())
+		return
+	}
+
+	if mute.UserId == "" {
+		err := &validationError{fieldErrors{"userId: is required"}}
+		sendError(logger, state, dispatcher, []runtime.Presence{message}, protocol.ErrorCodeBadMessage, err.Error())
+		return
+	}
+
+	if player.UserId != state.HostUserId {
+		sendError(logger, state, dispatcher, []runtime.Presence{message}, protocol.ErrorCodeNotHost, "Only the host can mute players")
+		return
+	}
+
+	logger.Info("host %s set muted=%v for %s in match %s", player.UserId, mute.Muted, mute.UserId, state.MatchId)
+	if mute.Muted {
+		state.MutedUserIds[mute.UserId] = true
+	} else {
+		delete(state.MutedUserIds, mute.UserId)
+	}
+}
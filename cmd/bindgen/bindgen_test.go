@@ -0,0 +1,26 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The committed bindings are the golden files. If this fails, regenerate them
+// with go generate ./protocol and commit the result.
+func TestBindingsMatchProtocol(t *testing.T) {
+	bindings, err := generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range bindings {
+		got, err := os.ReadFile(filepath.Join("..", "..", "bindings", name))
+		if err != nil {
+			t.Fatalf("reading %s: %v", name, err)
+		}
+		if string(got) != want {
+			t.Errorf("bindings/%s is out of date with the protocol package, run go generate ./protocol", name)
+		}
+	}
+}
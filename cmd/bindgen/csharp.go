@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"imps/mpserver/protocol"
+)
+
+const csharpNamespace = "Imps.Lobby.Protocol"
+
+var rawMessageType = reflect.TypeOf(json.RawMessage{})
+
+func csharpType(t reflect.Type) (string, error) {
+	if t == rawMessageType {
+		return "JToken", nil
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return "bool", nil
+	case reflect.String:
+		return "string", nil
+	case reflect.Int, reflect.Int32:
+		return "int", nil
+	case reflect.Int64:
+		return "long", nil
+	case reflect.Float64:
+		return "double", nil
+	case reflect.Struct:
+		return t.Name(), nil
+	case reflect.Slice:
+		elem, err := csharpType(t.Elem())
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("List<%s>", elem), nil
+	case reflect.Map:
+		key, err := csharpType(t.Key())
+		if err != nil {
+			return "", err
+		}
+		elem, err := csharpType(t.Elem())
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Dictionary<%s, %s>", key, elem), nil
+	}
+	return "", fmt.Errorf("no C# type for %s", t)
+}
+
+func csharpLiteral(v interface{}) (string, string) {
+	switch v := v.(type) {
+	case string:
+		return "string", fmt.Sprintf("%q", v)
+	default:
+		return "int", fmt.Sprintf("%v", v)
+	}
+}
+
+func generateCSharp() (string, error) {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "// %s\n\n", header)
+	b.WriteString("using System.Collections.Generic;\n")
+	b.WriteString("using Newtonsoft.Json;\n")
+	b.WriteString("using Newtonsoft.Json.Linq;\n\n")
+	fmt.Fprintf(&b, "namespace %s\n{\n", csharpNamespace)
+
+	b.WriteString("    public static class LobbyProtocol\n    {\n")
+	for _, c := range protocol.Constants {
+		typ, literal := csharpLiteral(c.Value)
+		fmt.Fprintf(&b, "        public const %s %s = %s;\n", typ, c.Name, literal)
+	}
+	b.WriteString("    }\n\n")
+
+	b.WriteString("    public static class OpCodes\n    {\n")
+	for _, op := range protocol.OpCodes {
+		fmt.Fprintf(&b, "        public const long %s = %v;\n", op.Name, op.Value)
+	}
+	b.WriteString("    }\n\n")
+
+	for ix, group := range protocol.StringGroups {
+		if ix > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "    public static class %s\n    {\n", group.Name)
+		for _, v := range group.Values {
+			_, literal := csharpLiteral(v.Value)
+			fmt.Fprintf(&b, "        public const string %s = %s;\n", v.Name, literal)
+		}
+		b.WriteString("    }\n")
+	}
+
+	for _, t := range messageTypes() {
+		fmt.Fprintf(&b, "\n    public class %s\n    {\n", t.Name())
+		for _, f := range messageFields(t) {
+			typ, err := csharpType(f.Type)
+			if err != nil {
+				return "", fmt.Errorf("%s.%s: %w", t.Name(), f.GoName, err)
+			}
+
+			attribute := fmt.Sprintf("[JsonProperty(%q)]", f.JsonName)
+			if f.Optional {
+				attribute = fmt.Sprintf("[JsonProperty(%q, NullValueHandling = NullValueHandling.Ignore)]", f.JsonName)
+			}
+			fmt.Fprintf(&b, "        %s\n        public %s %s { get; set; }\n", attribute, typ, f.GoName)
+		}
+		b.WriteString("    }\n")
+	}
+
+	b.WriteString("}\n")
+	return b.String(), nil
+}
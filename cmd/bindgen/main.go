@@ -0,0 +1,106 @@
+// Command bindgen generates C# and TypeScript bindings for the lobby protocol
+// from the definitions in imps/mpserver/protocol. Run it through go generate
+// in the protocol package rather than directly.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"imps/mpserver/protocol"
+)
+
+const header = "Code generated by bindgen from imps/mpserver/protocol. DO NOT EDIT."
+
+// Where each binding is written, relative to -out
+const (
+	csharpFile     = "csharp/LobbyProtocol.cs"
+	typescriptFile = "typescript/lobbyProtocol.ts"
+)
+
+// messageField is a struct field as it appears on the wire.
+type messageField struct {
+	GoName   string
+	JsonName string
+	Type     reflect.Type
+	Optional bool
+}
+
+func messageFields(t reflect.Type) []messageField {
+	fields := make([]messageField, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = f.Name
+		}
+
+		fields = append(fields, messageField{
+			GoName:   f.Name,
+			JsonName: name,
+			Type:     f.Type,
+			Optional: strings.Contains(options, "omitempty"),
+		})
+	}
+	return fields
+}
+
+func messageTypes() []reflect.Type {
+	types := make([]reflect.Type, 0, len(protocol.Messages))
+	for _, m := range protocol.Messages {
+		types = append(types, reflect.TypeOf(m))
+	}
+	return types
+}
+
+// generate renders every binding, keyed by its path relative to -out.
+func generate() (map[string]string, error) {
+	cs, err := generateCSharp()
+	if err != nil {
+		return nil, fmt.Errorf("generating C#: %w", err)
+	}
+	ts, err := generateTypeScript()
+	if err != nil {
+		return nil, fmt.Errorf("generating TypeScript: %w", err)
+	}
+
+	return map[string]string{
+		csharpFile:     cs,
+		typescriptFile: ts,
+	}, nil
+}
+
+func main() {
+	out := flag.String("out", "bindings", "directory to write the bindings to")
+	flag.Parse()
+
+	bindings, err := generate()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	for name, contents := range bindings {
+		path := filepath.Join(*out, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+}
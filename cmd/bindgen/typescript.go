@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"imps/mpserver/protocol"
+)
+
+func typescriptType(t reflect.Type) (string, error) {
+	if t == rawMessageType {
+		return "unknown", nil
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean", nil
+	case reflect.String:
+		return "string", nil
+	case reflect.Int, reflect.Int32, reflect.Int64, reflect.Float64:
+		return "number", nil
+	case reflect.Struct:
+		return t.Name(), nil
+	case reflect.Slice:
+		elem, err := typescriptType(t.Elem())
+		if err != nil {
+			return "", err
+		}
+		return elem + "[]", nil
+	case reflect.Map:
+		key, err := typescriptType(t.Key())
+		if err != nil {
+			return "", err
+		}
+		elem, err := typescriptType(t.Elem())
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Record<%s, %s>", key, elem), nil
+	}
+	return "", fmt.Errorf("no TypeScript type for %s", t)
+}
+
+var wordBoundary = regexp.MustCompile(`([a-z0-9])([A-Z])`)
+
+// screamingSnake turns a Go name like MinVersion into MIN_VERSION.
+func screamingSnake(name string) string {
+	return strings.ToUpper(wordBoundary.ReplaceAllString(name, "${1}_${2}"))
+}
+
+func typescriptLiteral(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return fmt.Sprintf("%q", s)
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+func generateTypeScript() (string, error) {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "// %s\n\n", header)
+
+	for _, c := range protocol.Constants {
+		fmt.Fprintf(&b, "export const PROTOCOL_%s = %s;\n", screamingSnake(c.Name), typescriptLiteral(c.Value))
+	}
+	b.WriteString("\n")
+
+	for _, op := range protocol.OpCodes {
+		fmt.Fprintf(&b, "export const %s = %v;\n", op.Name, op.Value)
+	}
+	b.WriteString("\n")
+
+	for ix, group := range protocol.StringGroups {
+		if ix > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "export const %s = {\n", group.Name)
+		for _, v := range group.Values {
+			fmt.Fprintf(&b, "  %s: %s,\n", v.Name, typescriptLiteral(v.Value))
+		}
+		b.WriteString("} as const;\n")
+	}
+
+	for _, t := range messageTypes() {
+		fields := messageFields(t)
+		if len(fields) == 0 {
+			fmt.Fprintf(&b, "\nexport type %s = Record<string, never>;\n", t.Name())
+			continue
+		}
+
+		fmt.Fprintf(&b, "\nexport interface %s {\n", t.Name())
+		for _, f := range fields {
+			typ, err := typescriptType(f.Type)
+			if err != nil {
+				return "", fmt.Errorf("%s.%s: %w", t.Name(), f.GoName, err)
+			}
+
+			optional := ""
+			if f.Optional {
+				optional = "?"
+			}
+			fmt.Fprintf(&b, "  %s%s: %s;\n", f.JsonName, optional, typ)
+		}
+		b.WriteString("}\n")
+	}
+
+	return b.String(), nil
+}
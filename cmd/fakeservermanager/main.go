@@ -0,0 +1,70 @@
+// Command fakeservermanager runs the fake game server manager from
+// imps/mpserver/fakeservermanager, so the backend can be run without the real
+// one. See docker-compose.fake.yml to use it in place of the real one.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"imps/mpserver/fakeservermanager"
+)
+
+func main() {
+	addr := flag.String("addr", ":5000", "address to listen on")
+	host := flag.String("host", "localhost", "address players are told to connect to")
+	ports := flag.String("ports", "9000-9050", "range of ports to hand out, one per game server")
+	capacity := flag.Int("capacity", -1, "most game servers at once, defaults to the number of ports")
+	latency := flag.Duration("latency", 0, "delay added to every request")
+	failureRate := flag.Float64("failure-rate", 0, "fraction of requests, from 0 to 1, that fail with a 500")
+	flag.Parse()
+
+	first, last, err := parsePorts(*ports)
+	if err != nil {
+		log.Fatalf("invalid -ports: %v", err)
+	}
+	if *capacity < 0 {
+		*capacity = last - first + 1
+	}
+	if *capacity > last-first+1 {
+		log.Fatalf("-capacity %d is more than the %d ports in %s", *capacity, last-first+1, *ports)
+	}
+	if *failureRate < 0 || *failureRate > 1 {
+		log.Fatalf("-failure-rate must be between 0 and 1")
+	}
+
+	server := fakeservermanager.New(fakeservermanager.Options{
+		Host:        *host,
+		BasePort:    first,
+		Capacity:    *capacity,
+		Latency:     *latency,
+		FailureRate: *failureRate,
+	})
+
+	log.Printf("fake server manager listening on %s with capacity %d, latency %v and failure rate %v",
+		*addr, *capacity, *latency, *failureRate)
+	log.Fatal(http.ListenAndServe(*addr, server))
+}
+
+func parsePorts(ports string) (int, int, error) {
+	lo, hi, ok := strings.Cut(ports, "-")
+	if !ok {
+		hi = lo
+	}
+	first, err := strconv.Atoi(lo)
+	if err != nil {
+		return 0, 0, err
+	}
+	last, err := strconv.Atoi(hi)
+	if err != nil {
+		return 0, 0, err
+	}
+	if first < 1 || last > 65535 || first > last {
+		return 0, 0, fmt.Errorf("%q is not a range of ports like 9000-9050", ports)
+	}
+	return first, last, nil
+}
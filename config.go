@@ -0,0 +1,315 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// Keys read from the runtime env, which is set under runtime.env in the
+// Nakama config. Anything left out keeps its default.
+const (
+	envTickRate            = "LOBBY_TICK_RATE"
+	envEmptyTimeout        = "LOBBY_EMPTY_TIMEOUT"
+	envAllocationRetry     = "LOBBY_ALLOCATION_RETRY"
+	envServerManagers      = "LOBBY_SERVER_MANAGERS"
+	envHealthCheckInterval = "LOBBY_HEALTH_CHECK_INTERVAL"
+	envRegions             = "LOBBY_REGIONS"
+	envGameModesFile       = "LOBBY_GAME_MODES_FILE"
+	envChatFilter          = "LOBBY_CHAT_FILTER"
+	envRecordDir           = "LOBBY_RECORD_DIR"
+	envCheckInvariants     = "LOBBY_CHECK_INVARIANTS"
+	envSnapshotInterval    = "LOBBY_SNAPSHOT_INTERVAL"
+	envSnapshotMaxAge      = "LOBBY_SNAPSHOT_MAX_AGE"
+	envRecoveryTimeout     = "LOBBY_RECOVERY_TIMEOUT"
+	envAnalyticsSink       = "LOBBY_ANALYTICS_SINK"
+	envAnalyticsBatchSize  = "LOBBY_ANALYTICS_BATCH_SIZE"
+	envAnalyticsFlush      = "LOBBY_ANALYTICS_FLUSH_INTERVAL"
+	envRateLimits          = "LOBBY_RATE_LIMITS"
+)
+
+// Nakama won't run a match faster than this
+const maxTickRate = 60
+
+// LobbyConfig holds the settings that can change between environments. It is
+// loaded once by InitModule and never changes afterwards, so it is shared
+// without locking. Player counts are per game mode, so they live in the game
+// mode catalog instead.
+type LobbyConfig struct {
+	TickRate int
+	// How long a lobby lives with nobody in it
+	EmptyTimeout time.Duration
+	// How long a lobby waiting for capacity goes between allocation attempts
+	AllocationRetry     time.Duration
+	ServerManagers      []serverManagerConfig
+	HealthCheckInterval time.Duration
+	// In order of preference when there is no latency data to choose between them
+	Regions       []string
+	GameModesFile string
+	// Words masked in chat
+	ChatFilter []string
+	chatFilter *regexp.Regexp
+	// Lobbies are recorded here for replay when set, see recorder.go
+	RecordDir string
+	// Check lobby state for consistency after every callback, see invariants.go
+	CheckInvariants bool
+	// How often lobbies save a snapshot for recovery after a restart, see
+	// snapshot.go
+	SnapshotInterval time.Duration
+	// Snapshots older than this are too old to recover from
+	SnapshotMaxAge time.Duration
+	// How long a recovered lobby waits for its players before the empty
+	// timeout applies
+	RecoveryTimeout time.Duration
+	// Where lobby events are forwarded, see analytics.go. Events aren't
+	// emitted at all when it is empty.
+	AnalyticsSink          string
+	AnalyticsBatchSize     int
+	AnalyticsFlushInterval time.Duration
+	// How many messages of each opcode a session may send, see rate_limit.go
+	RateLimits map[int64]rateLimit
+}
+
+// defaultLobbyConfig is the config for the local docker-compose setup.
+func defaultLobbyConfig() *LobbyConfig {
+	return &LobbyConfig{
+		TickRate:            10,
+		EmptyTimeout:        10 * time.Second,
+		AllocationRetry:     15 * time.Second,
+		ServerManagers:      []serverManagerConfig{{Address: "http://servermanager:5000"}},
+		HealthCheckInterval: 10 * time.Second,
+		Regions:             []string{"us-east", "us-west", "eu-west"},
+		GameModesFile:       "/nakama/data/modules/game_modes.json",
+		ChatFilter:          []string{},
+		SnapshotInterval:    30 * time.Second,
+		SnapshotMaxAge:      time.Hour,
+		RecoveryTimeout:     5 * time.Minute,
+
+		AnalyticsBatchSize:     100,
+		AnalyticsFlushInterval: 10 * time.Second,
+
+		RateLimits: copyRateLimits(defaultOpcodeRateLimits),
+	}
+}
+
+// loadLobbyConfig applies the env on top of the defaults. Every problem with
+// the env is reported at once, keyed by env var.
+func loadLobbyConfig(env map[string]string) (*LobbyConfig, error) {
+	c := defaultLobbyConfig()
+	var errs fieldErrors
+
+	if v, ok := env[envTickRate]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxTickRate {
+			errs.add(envTickRate, "must be an integer between 1 and %d", maxTickRate)
+		}
+		c.TickRate = n
+	}
+	parseDuration(env, envEmptyTimeout, &c.EmptyTimeout, &errs)
+	parseDuration(env, envAllocationRetry, &c.AllocationRetry, &errs)
+	parseDuration(env, envHealthCheckInterval, &c.HealthCheckInterval, &errs)
+	parseDuration(env, envSnapshotInterval, &c.SnapshotInterval, &errs)
+	parseDuration(env, envSnapshotMaxAge, &c.SnapshotMaxAge, &errs)
+	parseDuration(env, envRecoveryTimeout, &c.RecoveryTimeout, &errs)
+	parseDuration(env, envAnalyticsFlush, &c.AnalyticsFlushInterval, &errs)
+
+	if v, ok := env[envServerManagers]; ok {
+		c.ServerManagers = parseServerManagers(v)
+	}
+	if v, ok := env[envRegions]; ok {
+		c.Regions = splitList(v)
+	}
+	if v, ok := env[envGameModesFile]; ok {
+		c.GameModesFile = strings.TrimSpace(v)
+	}
+	if v, ok := env[envChatFilter]; ok {
+		c.ChatFilter = splitList(v)
+	}
+	if v, ok := env[envRecordDir]; ok {
+		c.RecordDir = strings.TrimSpace(v)
+	}
+	if v, ok := env[envCheckInvariants]; ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			errs.add(envCheckInvariants, "must be true or false")
+		}
+		c.CheckInvariants = b
+	}
+	if v, ok := env[envAnalyticsSink]; ok {
+		c.AnalyticsSink = strings.TrimSpace(v)
+		if _, err := newAnalyticsSink(c.AnalyticsSink); c.AnalyticsSink != "" && err != nil {
+			errs.add(envAnalyticsSink, "%v", err)
+		}
+	}
+	if v, ok := env[envAnalyticsBatchSize]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			errs.add(envAnalyticsBatchSize, "must be a positive integer")
+		}
+		c.AnalyticsBatchSize = n
+	}
+	if v, ok := env[envRateLimits]; ok {
+		parseRateLimits(v, c.RateLimits, &errs)
+	}
+
+	if len(c.ServerManagers) == 0 {
+		errs.add(envServerManagers, "must list at least one server manager")
+	}
+	for _, m := range c.ServerManagers {
+		if m.Region != "" && !contains(c.Regions, m.Region) {
+			errs.add(envServerManagers, "region %s of %s must be one of %s", m.Region, m.Address, strings.Join(c.Regions, ", "))
+		}
+	}
+	if len(c.Regions) == 0 {
+		errs.add(envRegions, "must list at least one region")
+	}
+	if c.GameModesFile == "" {
+		errs.add(envGameModesFile, "must not be empty")
+	}
+
+	if len(errs) > 0 {
+		return nil, &validationError{errs}
+	}
+	c.chatFilter = newWordFilter(c.ChatFilter)
+	return c, nil
+}
+
+func parseDuration(env map[string]string, key string, d *time.Duration, errs *fieldErrors) {
+	v, ok := env[key]
+	if !ok {
+		return
+	}
+	parsed, err := time.ParseDuration(v)
+	if err != nil || parsed <= 0 {
+		errs.add(key, "must be a positive duration such as 10s")
+		return
+	}
+	*d = parsed
+}
+
+// parseServerManagers reads a comma separated list of server manager
+// addresses, each optionally prefixed with the region it serves, like
+// "us-east=http://sm-east:5000,http://sm-any:5000".
+func parseServerManagers(v string) []serverManagerConfig {
+	managers := make([]serverManagerConfig, 0)
+	for _, entry := range splitList(v) {
+		region, address, ok := strings.Cut(entry, "=")
+		if !ok {
+			region, address = "", entry
+		}
+		managers = append(managers, serverManagerConfig{Address: address, Region: region})
+	}
+	return managers
+}
+
+// parseRateLimits reads a comma separated list of opcode limits, each the
+// burst and the refill per second, like "9=5/1,13=3/0.5", into limits.
+// Opcodes it doesn't list keep the limits they have.
+func parseRateLimits(v string, limits map[int64]rateLimit, errs *fieldErrors) {
+	for _, entry := range splitList(v) {
+		op, limit, ok := strings.Cut(entry, "=")
+		burst, perSecond, ok2 := strings.Cut(limit, "/")
+		if !ok || !ok2 {
+			errs.add(envRateLimits, "entry %q must look like opcode=burst/persecond", entry)
+			continue
+		}
+		opCode, err := strconv.ParseInt(strings.TrimSpace(op), 10, 64)
+		if _, known := defaultOpcodeRateLimits[opCode]; err != nil || !known {
+			errs.add(envRateLimits, "opcode %s isn't one clients send", op)
+			continue
+		}
+		b, err := strconv.ParseFloat(strings.TrimSpace(burst), 64)
+		if err != nil || b < 1 {
+			errs.add(envRateLimits, "burst %s of opcode %d must be at least 1", burst, opCode)
+			continue
+		}
+		r, err := strconv.ParseFloat(strings.TrimSpace(perSecond), 64)
+		if err != nil || r <= 0 || math.IsInf(r, 0) {
+			errs.add(envRateLimits, "refill %s of opcode %d must be a positive number", perSecond, opCode)
+			continue
+		}
+		limits[opCode] = rateLimit{Burst: b, PerSecond: r}
+	}
+}
+
+func copyRateLimits(limits map[int64]rateLimit) map[int64]rateLimit {
+	c := make(map[int64]rateLimit, len(limits))
+	for op, limit := range limits {
+		c[op] = limit
+	}
+	return c
+}
+
+// formatRateLimits writes limits back out the way LOBBY_RATE_LIMITS takes
+// them, in opcode order.
+func formatRateLimits(limits map[int64]rateLimit) string {
+	ops := make([]int64, 0, len(limits))
+	for op := range limits {
+		ops = append(ops, op)
+	}
+	sort.Slice(ops, func(i, j int) bool { return ops[i] < ops[j] })
+
+	entries := make([]string, 0, len(ops))
+	for _, op := range ops {
+		entries = append(entries, fmt.Sprintf("%d=%g/%g", op, limits[op].Burst, limits[op].PerSecond))
+	}
+	return strings.Join(entries, ",")
+}
+
+func splitList(v string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// ticks converts a duration to match ticks, rounding up so short durations
+// still last at least a tick.
+func (c *LobbyConfig) ticks(d time.Duration) int64 {
+	return int64(math.Ceil(d.Seconds() * float64(c.TickRate)))
+}
+
+// duration converts match ticks back to the time they take.
+func (c *LobbyConfig) duration(ticks int64) time.Duration {
+	return time.Duration(ticks) * time.Second / time.Duration(c.TickRate)
+}
+
+// log writes out the effective config, so it's clear what a node is running
+// with. The chat filter is only counted, since nobody wants it in the logs.
+func (c *LobbyConfig) log(logger runtime.Logger) {
+	managers := make([]string, 0, len(c.ServerManagers))
+	for _, m := range c.ServerManagers {
+		if m.Region == "" {
+			managers = append(managers, m.Address)
+		} else {
+			managers = append(managers, m.Region+"="+m.Address)
+		}
+	}
+	logger.Info("lobby config: %s=%d %s=%v %s=%v %s=%s %s=%v %s=%s %s=%s %s=(%d words) %s=%s %s=%v %s=%v %s=%v %s=%v %s=%s %s=%d %s=%v %s=%s",
+		envTickRate, c.TickRate,
+		envEmptyTimeout, c.EmptyTimeout,
+		envAllocationRetry, c.AllocationRetry,
+		envServerManagers, strings.Join(managers, ","),
+		envHealthCheckInterval, c.HealthCheckInterval,
+		envRegions, strings.Join(c.Regions, ","),
+		envGameModesFile, c.GameModesFile,
+		envChatFilter, len(c.ChatFilter),
+		envRecordDir, c.RecordDir,
+		envCheckInvariants, c.CheckInvariants,
+		envSnapshotInterval, c.SnapshotInterval,
+		envSnapshotMaxAge, c.SnapshotMaxAge,
+		envRecoveryTimeout, c.RecoveryTimeout,
+		envAnalyticsSink, c.AnalyticsSink,
+		envAnalyticsBatchSize, c.AnalyticsBatchSize,
+		envAnalyticsFlush, c.AnalyticsFlushInterval,
+		envRateLimits, formatRateLimits(c.RateLimits))
+}
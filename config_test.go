@@ -0,0 +1,61 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"imps/mpserver/protocol"
+)
+
+func TestRateLimitConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    map[int64]rateLimit
+		wantErr string
+	}{
+		{name: "defaults", want: defaultOpcodeRateLimits},
+		{
+			name:  "overrides",
+			value: "9=10/2, 13=1/0.1",
+			want: func() map[int64]rateLimit {
+				limits := copyRateLimits(defaultOpcodeRateLimits)
+				limits[protocol.OP_CHAT_SEND] = rateLimit{Burst: 10, PerSecond: 2}
+				limits[protocol.OP_LOBBY_SETTINGS] = rateLimit{Burst: 1, PerSecond: 0.1}
+				return limits
+			}(),
+		},
+		{name: "not a limit", value: "9=10", wantErr: `entry "9=10" must look like opcode=burst/persecond`},
+		{name: "outbound opcode", value: "2=10/2", wantErr: "opcode 2 isn't one clients send"},
+		{name: "burst below one", value: "9=0.5/2", wantErr: "burst 0.5 of opcode 9 must be at least 1"},
+		{name: "no refill", value: "9=10/0", wantErr: "refill 0 of opcode 9 must be a positive number"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{}
+			if tt.value != "" {
+				env[envRateLimits] = tt.value
+			}
+			config, err := loadLobbyConfig(env)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(config.RateLimits, tt.want) {
+				t.Errorf("rate limits = %v, want %v", config.RateLimits, tt.want)
+			}
+		})
+	}
+
+	// Overrides don't leak into the defaults other lobbies start from
+	if limit := defaultOpcodeRateLimits[protocol.OP_CHAT_SEND]; limit.Burst != 5 {
+		t.Errorf("default chat limit changed to %+v", limit)
+	}
+}
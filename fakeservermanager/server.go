@@ -0,0 +1,233 @@
+// Package fakeservermanager is a stand-in for the game server manager, for
+// local development and tests. It speaks the same HTTP contract the
+// allocator uses but only hands out made up servers, with optional latency,
+// failures and a capacity limit to exercise the lobby's error handling.
+package fakeservermanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Options struct {
+	// Address players are told to connect to
+	Host string
+	// Game servers are handed ports from BasePort up, one per server, so
+	// Capacity servers can run at once
+	BasePort int
+	Capacity int
+	// Added to every request before it is answered
+	Latency time.Duration
+	// Fraction of requests, from 0 to 1, answered with a 500
+	FailureRate float64
+	// Used to decide which requests fail. Defaults to a time seeded source.
+	Rand *rand.Rand
+}
+
+// GameServer is a server the fake has allocated, as it appears in responses.
+type GameServer struct {
+	ServerId  string          `json:"serverId"`
+	MatchId   string          `json:"matchId"`
+	Region    string          `json:"region"`
+	Host      string          `json:"host"`
+	Port      int             `json:"port"`
+	Settings  json.RawMessage `json:"settings,omitempty"`
+	CreatedAt time.Time       `json:"createdAt"`
+
+	seq int
+}
+
+type allocationRequest struct {
+	MatchId  string          `json:"matchId"`
+	Region   string          `json:"region"`
+	Settings json.RawMessage `json:"settings"`
+}
+
+// Server implements the server manager endpoints:
+//
+//	POST   /GameServer      allocate a server, 503 when at capacity
+//	GET    /GameServer      list allocated servers
+//	DELETE /GameServer/{id} release a server, 404 if it isn't allocated
+//	GET    /Health          report free capacity
+type Server struct {
+	mu       sync.Mutex
+	options  Options
+	servers  map[string]*GameServer
+	nextId   int
+	released []string
+}
+
+var _ http.Handler = (*Server)(nil)
+
+func New(options Options) *Server {
+	if options.Host == "" {
+		options.Host = "localhost"
+	}
+	if options.Rand == nil {
+		options.Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return &Server{
+		options: options,
+		servers: make(map[string]*GameServer),
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	latency := s.options.Latency
+	fail := s.options.FailureRate > 0 && s.options.Rand.Float64() < s.options.FailureRate
+	s.mu.Unlock()
+
+	time.Sleep(latency)
+	if fail {
+		http.Error(w, "injected failure", http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/Health" && r.Method == http.MethodGet:
+		s.health(w)
+	case r.URL.Path == "/GameServer" && r.Method == http.MethodPost:
+		s.allocate(w, r)
+	case r.URL.Path == "/GameServer" && r.Method == http.MethodGet:
+		s.list(w)
+	case strings.HasPrefix(r.URL.Path, "/GameServer/") && r.Method == http.MethodDelete:
+		s.release(w, strings.TrimPrefix(r.URL.Path, "/GameServer/"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) health(w http.ResponseWriter) {
+	s.mu.Lock()
+	free := s.options.Capacity - len(s.servers)
+	s.mu.Unlock()
+
+	if free < 0 {
+		free = 0
+	}
+	writeJSON(w, map[string]int{"freeCapacity": free})
+}
+
+func (s *Server) allocate(w http.ResponseWriter, r *http.Request) {
+	var request allocationRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.MatchId == "" {
+		http.Error(w, "expected a JSON body with a matchId", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	port, ok := s.freePort()
+	if !ok {
+		s.mu.Unlock()
+		http.Error(w, "no game servers available", http.StatusServiceUnavailable)
+		return
+	}
+	s.nextId++
+	server := &GameServer{
+		ServerId:  fmt.Sprintf("fake-%d", s.nextId),
+		MatchId:   request.MatchId,
+		Region:    request.Region,
+		Host:      s.options.Host,
+		Port:      port,
+		Settings:  request.Settings,
+		CreatedAt: time.Now().UTC(),
+		seq:       s.nextId,
+	}
+	s.servers[server.ServerId] = server
+	s.mu.Unlock()
+
+	writeJSON(w, server)
+}
+
+// freePort finds the lowest port no server is using, if there is room for
+// another server.
+func (s *Server) freePort() (int, bool) {
+	if len(s.servers) >= s.options.Capacity {
+		return 0, false
+	}
+
+	used := make(map[int]bool, len(s.servers))
+	for _, server := range s.servers {
+		used[server.Port] = true
+	}
+	for port := s.options.BasePort; ; port++ {
+		if !used[port] {
+			return port, true
+		}
+	}
+}
+
+func (s *Server) list(w http.ResponseWriter) {
+	writeJSON(w, s.Servers())
+}
+
+func (s *Server) release(w http.ResponseWriter, serverId string) {
+	s.mu.Lock()
+	_, ok := s.servers[serverId]
+	if ok {
+		delete(s.servers, serverId)
+		s.released = append(s.released, serverId)
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		http.NotFound(w, nil)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// Servers returns the allocated servers, oldest first.
+func (s *Server) Servers() []GameServer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	servers := make([]GameServer, 0, len(s.servers))
+	for _, server := range s.servers {
+		servers = append(servers, *server)
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].seq < servers[j].seq
+	})
+	return servers
+}
+
+// Released returns the IDs of every server released so far, in order.
+func (s *Server) Released() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.released...)
+}
+
+// The setters below change the fake's behaviour while it runs, so a test can
+// take capacity away or start failing requests partway through.
+
+func (s *Server) SetCapacity(capacity int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.options.Capacity = capacity
+}
+
+func (s *Server) SetLatency(latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.options.Latency = latency
+}
+
+func (s *Server) SetFailureRate(rate float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.options.FailureRate = rate
+}
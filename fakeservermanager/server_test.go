@@ -0,0 +1,77 @@
+package fakeservermanager
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func do(t *testing.T, s *Server, method string, path string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+
+	data, _ := json.Marshal(body)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(method, path, bytes.NewReader(data)))
+	return w
+}
+
+func TestServer(t *testing.T) {
+	s := New(Options{BasePort: 9000, Capacity: 2})
+
+	steps := []struct {
+		method     string
+		path       string
+		body       interface{}
+		wantStatus int
+		wantBody   string
+	}{
+		{http.MethodGet, "/Health", nil, http.StatusOK, `{"freeCapacity":2}`},
+		{http.MethodPost, "/GameServer", map[string]string{"matchId": "a"}, http.StatusOK, ""},
+		{http.MethodPost, "/GameServer", map[string]string{"matchId": "b"}, http.StatusOK, ""},
+		{http.MethodPost, "/GameServer", map[string]string{"matchId": "c"}, http.StatusServiceUnavailable, ""},
+		{http.MethodPost, "/GameServer", map[string]string{}, http.StatusBadRequest, ""},
+		{http.MethodGet, "/Health", nil, http.StatusOK, `{"freeCapacity":0}`},
+		{http.MethodDelete, "/GameServer/fake-1", nil, http.StatusOK, ""},
+		{http.MethodDelete, "/GameServer/fake-1", nil, http.StatusNotFound, ""},
+		{http.MethodGet, "/Health", nil, http.StatusOK, `{"freeCapacity":1}`},
+	}
+	for _, step := range steps {
+		w := do(t, s, step.method, step.path, step.body)
+		if w.Code != step.wantStatus {
+			t.Fatalf("%s %s = %d, want %d", step.method, step.path, w.Code, step.wantStatus)
+		}
+		if step.wantBody != "" && string(bytes.TrimSpace(w.Body.Bytes())) != step.wantBody {
+			t.Fatalf("%s %s body = %s, want %s", step.method, step.path, w.Body.String(), step.wantBody)
+		}
+	}
+
+	// The released port is the first handed out again
+	w := do(t, s, http.MethodPost, "/GameServer", map[string]string{"matchId": "d"})
+	var server GameServer
+	json.Unmarshal(w.Body.Bytes(), &server)
+	if server.Port != 9000 || server.ServerId != "fake-3" {
+		t.Errorf("allocated %+v", server)
+	}
+
+	listed := s.Servers()
+	if len(listed) != 2 || listed[0].MatchId != "b" || listed[1].MatchId != "d" {
+		t.Errorf("servers = %+v", listed)
+	}
+	if released := s.Released(); len(released) != 1 || released[0] != "fake-1" {
+		t.Errorf("released = %v", released)
+	}
+}
+
+func TestServerFailureInjection(t *testing.T) {
+	s := New(Options{Capacity: 1, FailureRate: 1})
+	if w := do(t, s, http.MethodGet, "/Health", nil); w.Code != http.StatusInternalServerError {
+		t.Errorf("health with failure rate 1 = %d", w.Code)
+	}
+
+	s.SetFailureRate(0)
+	if w := do(t, s, http.MethodGet, "/Health", nil); w.Code != http.StatusOK {
+		t.Errorf("health with failure rate 0 = %d", w.Code)
+	}
+}
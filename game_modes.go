@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// The catalog ships next to the plugin as LobbyConfig.GameModesFile, and a
+// copy in storage overrides it so modes can be changed without a redeploy.
+const (
+	gameModesCollection = "config"
+	gameModesKey        = "game_modes"
+	// Storage objects owned by nobody belong to the system user
+	systemUserId = "00000000-0000-0000-0000-000000000000"
+)
+
+// Kinds of value a mode's rule can take
+const (
+	ruleTypeBool   = "bool"
+	ruleTypeInt    = "int"
+	ruleTypeChoice = "choice"
+)
+
+// ruleSpec describes one of a mode's rules. Min and Max bound int rules and
+// Choices lists the values a choice rule allows. Values are always strings on
+// the wire, so Default is too.
+type ruleSpec struct {
+	Type    string   `json:"type"`
+	Min     int      `json:"min"`
+	Max     int      `json:"max"`
+	Choices []string `json:"choices"`
+	Default string   `json:"default"`
+}
+
+// gameMode is everything a lobby may choose from for one mode. PlayerCount
+// players are needed to launch, and anyone past that observes. Teams is zero
+// for free for all. Time limits are in seconds.
+type gameMode struct {
+	PlayerCount      int                 `json:"playerCount"`
+	MaxObservers     int                 `json:"maxObservers"`
+	Teams            int                 `json:"teams"`
+	Ranked           bool                `json:"ranked"`
+	Maps             []string            `json:"maps"`
+	MinTimeLimit     int                 `json:"minTimeLimit"`
+	MaxTimeLimit     int                 `json:"maxTimeLimit"`
+	DefaultTimeLimit int                 `json:"defaultTimeLimit"`
+	Rules            map[string]ruleSpec `json:"rules"`
+}
+
+type gameModeCatalog struct {
+	DefaultMode string               `json:"defaultMode"`
+	Modes       map[string]*gameMode `json:"modes"`
+}
+
+func (c *gameModeCatalog) validate(errs *fieldErrors) {
+	if len(c.Modes) == 0 {
+		errs.add("modes", "must define at least one mode")
+	}
+	if _, ok := c.Modes[c.DefaultMode]; !ok {
+		errs.add("defaultMode", "must be one of the modes")
+	}
+
+	for _, name := range c.modeNames() {
+		field := "modes." + name
+		mode := c.Modes[name]
+		if mode == nil {
+			errs.add(field, "is required")
+			continue
+		}
+
+		if mode.PlayerCount < 1 {
+			errs.add(field+".playerCount", "must be at least 1")
+		}
+		if mode.MaxObservers < 0 {
+			errs.add(field+".maxObservers", "must not be negative")
+		}
+		if mode.Teams < 0 || (mode.Teams > 0 && mode.PlayerCount%mode.Teams != 0) {
+			errs.add(field+".teams", "must be zero or divide playerCount evenly")
+		}
+		if len(mode.Maps) == 0 {
+			errs.add(field+".maps", "must list at least one map")
+		}
+		if mode.MinTimeLimit < 1 || mode.MinTimeLimit > mode.MaxTimeLimit {
+			errs.add(field+".minTimeLimit", "must be between 1 and maxTimeLimit")
+		}
+		if mode.DefaultTimeLimit < mode.MinTimeLimit || mode.DefaultTimeLimit > mode.MaxTimeLimit {
+			errs.add(field+".defaultTimeLimit", "must be between minTimeLimit and maxTimeLimit")
+		}
+
+		rules := make([]string, 0, len(mode.Rules))
+		for rule := range mode.Rules {
+			rules = append(rules, rule)
+		}
+		sort.Strings(rules)
+
+		for _, rule := range rules {
+			spec := mode.Rules[rule]
+			ruleField := field + ".rules." + rule
+			switch {
+			case spec.Type == ruleTypeInt && spec.Min > spec.Max:
+				errs.add(ruleField+".min", "must not be more than max")
+			case spec.Type == ruleTypeChoice && len(spec.Choices) == 0:
+				errs.add(ruleField+".choices", "must list at least one choice")
+			default:
+				if err := spec.check(spec.Default); err != nil {
+					errs.add(ruleField+".default", "%v", err)
+				}
+			}
+		}
+	}
+}
+
+func (c *gameModeCatalog) modeNames() []string {
+	names := make([]string, 0, len(c.Modes))
+	for name := range c.Modes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// The catalog in use. It is swapped out whole by reloadGameModes, so callers
+// take it once and use that copy throughout.
+var (
+	gameModesMu sync.RWMutex
+	gameModes   *gameModeCatalog
+)
+
+func currentGameModes() *gameModeCatalog {
+	gameModesMu.RLock()
+	defer gameModesMu.RUnlock()
+	return gameModes
+}
+
+// reloadGameModes loads the catalog from storage, or from file if storage
+// doesn't have one, and puts it in use if it is valid. An invalid catalog
+// leaves the current one in place.
+func reloadGameModes(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, file string) error {
+	data, source, err := readGameModes(ctx, nk, file)
+	if err != nil {
+		return err
+	}
+
+	var catalog gameModeCatalog
+	if err := decodePayload(data, &catalog); err != nil {
+		return fmt.Errorf("game modes from %s: %w", source, err)
+	}
+
+	gameModesMu.Lock()
+	gameModes = &catalog
+	gameModesMu.Unlock()
+
+	logger.Info("loaded game modes %s from %s", strings.Join(catalog.modeNames(), ", "), source)
+	return nil
+}
+
+func readGameModes(ctx context.Context, nk runtime.NakamaModule, file string) ([]byte, string, error) {
+	objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{
+		Collection: gameModesCollection,
+		Key:        gameModesKey,
+		UserID:     systemUserId,
+	}})
+	if err != nil {
+		return nil, "", fmt.Errorf("reading game modes from storage: %w", err)
+	}
+	if len(objects) > 0 {
+		return []byte(objects[0].GetValue()), "storage", nil
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, "", fmt.Errorf("reading game modes: %w", err)
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, "", fmt.Errorf("%s is empty", file)
+	}
+	return data, file, nil
+}
@@ -5,9 +5,7 @@ go 1.18
 require (
 	github.com/heroiclabs/nakama-common v1.30.0
 	github.com/thoas/go-funk v0.9.3
+	google.golang.org/protobuf v1.31.0
 )
 
-require (
-	github.com/google/go-cmp v0.5.8 // indirect
-	google.golang.org/protobuf v1.31.0 // indirect
-)
+require github.com/google/go-cmp v0.5.8 // indirect
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+
+	"imps/mpserver/fakeservermanager"
+	"imps/mpserver/nakamatest"
+	"imps/mpserver/protocol"
+)
+
+// lobbyHarness runs a LobbyMatch the way Nakama would, one callback at a
+// time, against the nakamatest fakes.
+type lobbyHarness struct {
+	t             *testing.T
+	ctx           context.Context
+	logger        *nakamatest.Logger
+	nk            *nakamatest.NakamaModule
+	dispatcher    *nakamatest.Dispatcher
+	serverManager *fakeservermanager.Server
+	config        *LobbyConfig
+	match         runtime.Match
+	state         interface{}
+	tick          int64
+}
+
+func newLobbyHarness(t *testing.T, env map[string]string) *lobbyHarness {
+	t.Helper()
+
+	serverManager := fakeservermanager.New(fakeservermanager.Options{BasePort: 9000, Capacity: 10})
+	server := httptest.NewServer(serverManager)
+	t.Cleanup(server.Close)
+
+	if env == nil {
+		env = map[string]string{}
+	}
+	env[envServerManagers] = server.URL
+	env[envGameModesFile] = "game_modes.json"
+	config, err := loadLobbyConfig(env)
+	if err != nil {
+		t.Fatalf("loading config: %v", err)
+	}
+
+	nk := nakamatest.NewNakamaModule()
+	allocator := &releaseCounter{lobbyAllocator: newServerAllocator(config.ServerManagers)}
+	h := &lobbyHarness{
+		t:             t,
+		ctx:           context.WithValue(context.Background(), runtime.RUNTIME_CTX_MATCH_ID, "lobby.node"),
+		logger:        nakamatest.NewLogger(t),
+		nk:            nk,
+		dispatcher:    &nakamatest.Dispatcher{},
+		serverManager: serverManager,
+		config:        config,
+		match: &LobbyMatch{
+			config:    config,
+			allocator: allocator,
+			queue:     newAllocationQueue(),
+			metrics:   newLobbyMetrics(nk),
+			analytics: newLobbyAnalytics(nk),
+		},
+	}
+	if err := reloadGameModes(h.ctx, h.logger, h.nk, config.GameModesFile); err != nil {
+		t.Fatalf("loading game modes: %v", err)
+	}
+
+	// Runs before the server manager closes, so releases still going on in
+	// the background don't log after the test is over
+	t.Cleanup(func() {
+		deadline := time.Now().Add(5 * time.Second)
+		for len(serverManager.Released()) < allocator.releases() && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+	return h
+}
+
+// releaseCounter counts the game servers a lobby starts releasing.
+type releaseCounter struct {
+	lobbyAllocator
+
+	mu      sync.Mutex
+	started int
+}
+
+func (c *releaseCounter) ReleaseInBackground(logger runtime.Logger, backend string, serverId string) {
+	c.mu.Lock()
+	c.started++
+	c.mu.Unlock()
+	c.lobbyAllocator.ReleaseInBackground(logger, backend, serverId)
+}
+
+func (c *releaseCounter) releases() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.started
+}
+
+// record makes the harness run the lobby through a matchRecorder writing to
+// dir. It has to be called before init.
+func (h *lobbyHarness) record(dir string) {
+	lobby := h.match.(*LobbyMatch)
+	h.config.RecordDir = dir
+	h.match = newMatchRecorder(h.config, lobby.allocator, lobby.queue, lobby.metrics, lobby.analytics)
+}
+
+// init creates the lobby with create-lobby's params, hosted by host.
+func (h *lobbyHarness) init(host string, settings protocol.LobbySettings) {
+	h.t.Helper()
+
+	params := map[string]interface{}{
+		"isPrivate":  false,
+		"matchName":  "Play with " + host,
+		"hostUserId": host,
+		"settings":   withDefaults(currentGameModes(), settings),
+	}
+	state, tickRate, label := h.match.MatchInit(h.ctx, h.logger, nil, h.nk, params)
+	if state == nil {
+		h.t.Fatalf("MatchInit refused params %+v", params)
+	}
+	if tickRate != h.config.TickRate || label == "" {
+		h.t.Fatalf("MatchInit returned tick rate %d and label %q", tickRate, label)
+	}
+	h.state = state
+	h.check("MatchInit")
+}
+
+// join runs the join attempt and, if it is accepted, the join.
+func (h *lobbyHarness) join(p *nakamatest.Presence, metadata map[string]string) (bool, string) {
+	h.t.Helper()
+
+	state, accepted, reason := h.match.MatchJoinAttempt(h.ctx, h.logger, nil, h.nk, h.dispatcher, h.tick, h.state, p, metadata)
+	h.state = state
+	h.check("MatchJoinAttempt")
+	if accepted {
+		h.state = h.match.MatchJoin(h.ctx, h.logger, nil, h.nk, h.dispatcher, h.tick, h.state, []runtime.Presence{p})
+		h.check("MatchJoin")
+	}
+	return accepted, reason
+}
+
+func (h *lobbyHarness) leave(p *nakamatest.Presence) {
+	h.state = h.match.MatchLeave(h.ctx, h.logger, nil, h.nk, h.dispatcher, h.tick, h.state, []runtime.Presence{p})
+	h.check("MatchLeave")
+}
+
+// loop runs one tick with the messages.
+func (h *lobbyHarness) loop(messages ...runtime.MatchData) {
+	h.tick++
+	h.state = h.match.MatchLoop(h.ctx, h.logger, nil, h.nk, h.dispatcher, h.tick, h.state, messages)
+	h.check("MatchLoop")
+}
+
+// signal sends data to the lobby the way MatchSignal callers do.
+func (h *lobbyHarness) signal(data string) string {
+	state, result := h.match.MatchSignal(h.ctx, h.logger, nil, h.nk, h.dispatcher, h.tick, h.state, data)
+	h.state = state
+	h.check("MatchSignal")
+	return result
+}
+
+// terminate starts the server's shutdown, with graceSeconds to go.
+func (h *lobbyHarness) terminate(graceSeconds int) {
+	h.state = h.match.MatchTerminate(h.ctx, h.logger, nil, h.nk, h.dispatcher, h.tick, h.state, graceSeconds)
+	h.check("MatchTerminate")
+}
+
+// check fails the test if the callback left the lobby inconsistent.
+func (h *lobbyHarness) check(callback string) {
+	h.t.Helper()
+
+	if errs := reportInvariants(h.logger, callback, h.state); len(errs) > 0 {
+		h.t.Fatalf("%s broke invariants: %s", callback, strings.Join(errs, "; "))
+	}
+}
+
+func (h *lobbyHarness) lobby() *LobbyMatchState {
+	h.t.Helper()
+
+	state, ok := h.state.(*LobbyMatchState)
+	if !ok {
+		h.t.Fatalf("lobby ended, state is %#v", h.state)
+	}
+	return state
+}
+
+// message builds a JSON opcode message from p.
+func message(p *nakamatest.Presence, opCode int64, payload interface{}) runtime.MatchData {
+	data, _ := json.Marshal(payload)
+	return &nakamatest.MatchData{Presence: p, OpCode: opCode, Data: data}
+}
+
+// received decodes every JSON message with the opcode p was sent.
+func received[T any](h *lobbyHarness, p *nakamatest.Presence, opCode int64) []T {
+	h.t.Helper()
+
+	messages := make([]T, 0)
+	for _, b := range h.dispatcher.Received(p.SessionId, opCode) {
+		var msg T
+		if err := json.Unmarshal(b.Data, &msg); err != nil {
+			h.t.Fatalf("decoding opcode %d: %v", opCode, err)
+		}
+		messages = append(messages, msg)
+	}
+	return messages
+}
+
+func (h *lobbyHarness) label() protocol.LobbyLabel {
+	h.t.Helper()
+
+	var label protocol.LobbyLabel
+	if err := json.Unmarshal([]byte(h.dispatcher.Label()), &label); err != nil {
+		h.t.Fatalf("decoding label %q: %v", h.dispatcher.Label(), err)
+	}
+	return label
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// checkInvariants lists every way the lobby state contradicts itself. The
+// handlers keep these fields in step by hand, so this is what catches them
+// drifting apart.
+func checkInvariants(state *LobbyMatchState) fieldErrors {
+	var errs fieldErrors
+
+	joined := joinedPlayers(state)
+	if state.PlayerCount != len(joined) {
+		errs.add("PlayerCount", "is %d but %d players have joined", state.PlayerCount, len(joined))
+	}
+	if state.RequiredPlayerCount < 1 {
+		errs.add("RequiredPlayerCount", "is %d", state.RequiredPlayerCount)
+	}
+	if len(state.Players) > state.RequiredPlayerCount+state.AllowedObservers {
+		errs.add("Players", "has %d players, more than the %d player and %d observer slots", len(state.Players), state.RequiredPlayerCount, state.AllowedObservers)
+	}
+
+	slots := make(map[int]string)
+	for sessionId, p := range state.Players {
+		if p.Presence != nil && p.Presence.GetSessionId() != sessionId {
+			errs.add("Players."+sessionId, "holds the presence of session %s", p.Presence.GetSessionId())
+		}
+		if p.Presence != nil && p.UserId != p.Presence.GetUserId() {
+			errs.add("Players."+sessionId, "has user %q but the presence of user %s", p.UserId, p.Presence.GetUserId())
+		}
+		if p.Presence == nil && p.IsReady {
+			errs.add("Players."+sessionId, "is ready without having joined")
+		}
+		if p.SlotNumber < 0 || p.SlotNumber >= state.SlotNumber {
+			errs.add("Players."+sessionId, "has slot %d, outside the %d handed out", p.SlotNumber, state.SlotNumber)
+		}
+		if other, ok := slots[p.SlotNumber]; ok {
+			errs.add("Players."+sessionId, "shares slot %d with %s", p.SlotNumber, other)
+		}
+		slots[p.SlotNumber] = sessionId
+	}
+
+	// The first RequiredPlayerCount slots play, whether or not they've joined
+	// yet. Players who haven't joined get their role when they do. Recovered
+	// lobbies keep the roles from the game instead.
+	players := values(state.Players)
+	sort.Slice(players, func(a, b int) bool {
+		return players[a].SlotNumber < players[b].SlotNumber
+	})
+	for ix, p := range players {
+		want := ix >= state.RequiredPlayerCount
+		if state.Recovered {
+			want = state.Participants[p.UserId]
+		}
+		if p.Presence != nil && p.IsObserving != want {
+			errs.add("Players."+p.Presence.GetSessionId(), "has IsObserving %v in place %d with %d player slots", p.IsObserving, ix, state.RequiredPlayerCount)
+		}
+	}
+
+	if state.PlayerCount > 0 && !contains(userIds(joined), state.HostUserId) {
+		errs.add("HostUserId", "%q isn't in the lobby", state.HostUserId)
+	}
+
+	switch state.GameState {
+	case WaitingForPlayers, WaitingForPlayersReady:
+		if full := state.PlayerCount >= state.RequiredPlayerCount; full != (state.GameState == WaitingForPlayersReady) {
+			errs.add("GameState", "is %d with %d of %d players", state.GameState, state.PlayerCount, state.RequiredPlayerCount)
+		}
+		if !state.CanJoin && !state.ShuttingDown {
+			errs.add("CanJoin", "is false before the game started")
+		}
+	case WaitingForServer:
+		if !state.CanJoin {
+			errs.add("CanJoin", "is false before the game started")
+		}
+	case InProgress:
+		if state.CanJoin {
+			errs.add("CanJoin", "is true while the game is in progress")
+		}
+		if state.ServerBackend == "" {
+			errs.add("ServerBackend", "is empty while the game is in progress")
+		}
+	case Ended:
+	default:
+		errs.add("GameState", "is unknown state %d", state.GameState)
+	}
+	if (state.QueuePosition > 0) != (state.GameState == WaitingForServer) {
+		errs.add("QueuePosition", "is %d in state %d", state.QueuePosition, state.GameState)
+	}
+	if state.GameState != InProgress && state.ServerBackend != "" {
+		errs.add("ServerBackend", "is %s in state %d", state.ServerBackend, state.GameState)
+	}
+	if state.ServerBackend == "" && state.ServerId != "" {
+		errs.add("ServerId", "is %s without a backend", state.ServerId)
+	}
+
+	return errs
+}
+
+func userIds(players []*PlayerState) []string {
+	ids := make([]string, 0, len(players))
+	for _, p := range players {
+		ids = append(ids, p.UserId)
+	}
+	return ids
+}
+
+// reportInvariants logs any broken invariants after callback, with the whole
+// state so the problem can be worked back from.
+func reportInvariants(logger runtime.Logger, callback string, stateInterface interface{}) fieldErrors {
+	state, ok := stateInterface.(*LobbyMatchState)
+	if !ok {
+		return nil
+	}
+	errs := checkInvariants(state)
+	if len(errs) > 0 {
+		dump, _ := json.Marshal(state)
+		logger.Error("lobby %s broke invariants after %s: %s; state: %s", state.MatchId, callback, strings.Join(errs, "; "), dump)
+	}
+	return errs
+}
+
+// invariantChecker runs checkInvariants after every callback of the match it
+// wraps. It costs a pass over the state each time, so InitModule only uses it
+// when LOBBY_CHECK_INVARIANTS is set, as it is in local.dev.yml. Tests check
+// the state themselves.
+type invariantChecker struct {
+	match runtime.Match
+}
+
+var _ runtime.Match = (*invariantChecker)(nil)
+
+func (c *invariantChecker) MatchInit(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, params map[string]interface{}) (interface{}, int, string) {
+	state, tickRate, label := c.match.MatchInit(ctx, logger, db, nk, params)
+	reportInvariants(logger, "MatchInit", state)
+	return state, tickRate, label
+}
+
+func (c *invariantChecker) MatchJoinAttempt(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, dispatcher runtime.MatchDispatcher, tick int64, state interface{}, presence runtime.Presence, metadata map[string]string) (interface{}, bool, string) {
+	state, accepted, reason := c.match.MatchJoinAttempt(ctx, logger, db, nk, dispatcher, tick, state, presence, metadata)
+	reportInvariants(logger, "MatchJoinAttempt", state)
+	return state, accepted, reason
+}
+
+func (c *invariantChecker) MatchJoin(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, dispatcher runtime.MatchDispatcher, tick int64, state interface{}, presences []runtime.Presence) interface{} {
+	state = c.match.MatchJoin(ctx, logger, db, nk, dispatcher, tick, state, presences)
+	reportInvariants(logger, "MatchJoin", state)
+	return state
+}
+
+func (c *invariantChecker) MatchLeave(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, dispatcher runtime.MatchDispatcher, tick int64, state interface{}, presences []runtime.Presence) interface{} {
+	state = c.match.MatchLeave(ctx, logger, db, nk, dispatcher, tick, state, presences)
+	reportInvariants(logger, "MatchLeave", state)
+	return state
+}
+
+func (c *invariantChecker) MatchLoop(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, dispatcher runtime.MatchDispatcher, tick int64, state interface{}, messages []runtime.MatchData) interface{} {
+	state = c.match.MatchLoop(ctx, logger, db, nk, dispatcher, tick, state, messages)
+	reportInvariants(logger, "MatchLoop", state)
+	return state
+}
+
+func (c *invariantChecker) MatchTerminate(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, dispatcher runtime.MatchDispatcher, tick int64, state interface{}, graceSeconds int) interface{} {
+	state = c.match.MatchTerminate(ctx, logger, db, nk, dispatcher, tick, state, graceSeconds)
+	reportInvariants(logger, "MatchTerminate", state)
+	return state
+}
+
+func (c *invariantChecker) MatchSignal(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, dispatcher runtime.MatchDispatcher, tick int64, state interface{}, data string) (interface{}, string) {
+	state, result := c.match.MatchSignal(ctx, logger, db, nk, dispatcher, tick, state, data)
+	reportInvariants(logger, "MatchSignal", state)
+	return state, result
+}
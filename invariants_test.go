@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"imps/mpserver/nakamatest"
+	"imps/mpserver/protocol"
+)
+
+func TestInvariantsCatchDrift(t *testing.T) {
+	h := newLobbyHarness(t, nil)
+	h.init("host", protocol.LobbySettings{})
+	h.join(h.nk.AddUser("host", "Host"), deltaClient)
+	h.join(h.nk.AddUser("guest", "Guest"), deltaClient)
+
+	lobby := h.lobby()
+	lobby.PlayerCount--
+	lobby.GameState = InProgress
+
+	errs := checkInvariants(lobby)
+	want := []string{
+		"PlayerCount: is 1 but 2 players have joined",
+		"CanJoin: is true while the game is in progress",
+		"ServerBackend: is empty while the game is in progress",
+	}
+	if fmt.Sprint(errs) != fmt.Sprint(fieldErrors(want)) {
+		t.Errorf("checkInvariants = %q, want %q", errs, want)
+	}
+	if len(h.logger.Entries("ERROR")) != 0 {
+		t.Fatalf("logged errors before the state was broken")
+	}
+	reportInvariants(h.logger, "test", lobby)
+	if !h.logger.Contains("ERROR", `"PlayerCount":1`) {
+		t.Errorf("report doesn't include the state, got %v", h.logger.Entries("ERROR"))
+	}
+}
+
+// TestInvariantsHoldForRandomSessions throws random sequences of joins,
+// leaves, readies and settings changes at a lobby. The harness checks the
+// invariants after every callback, so any sequence that breaks one fails with
+// its seed, which replays it exactly.
+func TestInvariantsHoldForRandomSessions(t *testing.T) {
+	const sessions = 200
+	const steps = 150
+
+	for seed := int64(1); seed <= sessions; seed++ {
+		t.Run(fmt.Sprintf("seed %d", seed), func(t *testing.T) {
+			runRandomSession(t, rand.New(rand.NewSource(seed)), steps)
+		})
+	}
+}
+
+func runRandomSession(t *testing.T, rng *rand.Rand, steps int) {
+	h := newLobbyHarness(t, nil)
+	modes := currentGameModes().modeNames()
+	h.init("user-0", protocol.LobbySettings{Mode: modes[rng.Intn(len(modes))]})
+
+	// Everyone who has ever tried to join, so leaves and messages also come
+	// from sessions that are gone or never made it in
+	seen := make([]*nakamatest.Presence, 0)
+	pick := func() *nakamatest.Presence {
+		if len(seen) == 0 {
+			return nil
+		}
+		return seen[rng.Intn(len(seen))]
+	}
+
+	for step := 0; step < steps && h.state != nil; step++ {
+		switch op := rng.Intn(10); {
+		case op < 3:
+			p := h.nk.AddUser(fmt.Sprintf("user-%d", len(seen)), "Player")
+			seen = append(seen, p)
+			metadata := map[string]string{}
+			if rng.Intn(2) == 0 {
+				metadata = deltaClient
+			}
+			if rng.Intn(5) == 0 {
+				// A join attempt Nakama never follows up with a join
+				t.Logf("step %d: %s only reserves a slot", step, p.UserId)
+				h.state, _, _ = h.match.MatchJoinAttempt(h.ctx, h.logger, nil, h.nk, h.dispatcher, h.tick, h.state, p, metadata)
+				h.check("MatchJoinAttempt")
+			} else {
+				accepted, _ := h.join(p, metadata)
+				t.Logf("step %d: %s joins, accepted %v", step, p.UserId, accepted)
+			}
+		case op < 5:
+			if p := pick(); p != nil {
+				t.Logf("step %d: %s leaves", step, p.UserId)
+				h.leave(p)
+			}
+		case op < 7:
+			if p := pick(); p != nil {
+				t.Logf("step %d: %s readies", step, p.UserId)
+				h.loop(message(p, protocol.OP_READY, protocol.Ready{}))
+			}
+		case op < 8:
+			if host := hostPresence(h); host != nil {
+				mode := modes[rng.Intn(len(modes))]
+				t.Logf("step %d: host switches to %s", step, mode)
+				h.loop(message(host, protocol.OP_LOBBY_SETTINGS, withDefaults(currentGameModes(), protocol.LobbySettings{Mode: mode})))
+			}
+		case op < 9 && rng.Intn(20) == 0:
+			t.Logf("step %d: game ends", step)
+			h.state, _ = h.match.MatchSignal(h.ctx, h.logger, nil, h.nk, h.dispatcher, h.tick, h.state, signalGameEnded)
+			h.check("MatchSignal")
+		default:
+			h.loop()
+		}
+	}
+}
+
+// hostPresence finds the host's session, if they're in the lobby.
+func hostPresence(h *lobbyHarness) *nakamatest.Presence {
+	lobby := h.lobby()
+	sessions := make([]string, 0)
+	for sessionId, p := range lobby.Players {
+		if p.Presence != nil && p.UserId == lobby.HostUserId {
+			sessions = append(sessions, sessionId)
+		}
+	}
+	if len(sessions) == 0 {
+		return nil
+	}
+	sort.Strings(sessions)
+	return lobby.Players[sessions[0]].Presence.(*nakamatest.Presence)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+
+	"imps/mpserver/protocol"
+)
+
+// lobbyEvent is a change to the roster waiting to be sent as a LobbyDelta.
+// The player is captured when the event happens, so a player who left can
+// still be described.
+type lobbyEvent struct {
+	kind   string
+	player protocol.LobbyPlayer
+}
+
+func lobbyPlayerDto(p *PlayerState) protocol.LobbyPlayer {
+	return protocol.LobbyPlayer{
+		SessionId:   p.Presence.GetSessionId(),
+		UserId:      p.Presence.GetUserId(),
+		DisplayName: p.DisplayName,
+		IsReady:     p.IsReady,
+		IsObserving: p.IsObserving,
+		SlotNumber:  p.SlotNumber,
+	}
+}
+
+func newLobbyEvent(kind string, p *PlayerState) lobbyEvent {
+	return lobbyEvent{kind: kind, player: lobbyPlayerDto(p)}
+}
+
+// joinedPlayers are the players that have a presence, in slot order.
+func joinedPlayers(state *LobbyMatchState) []*PlayerState {
+	players := make([]*PlayerState, 0, len(state.Players))
+	for _, p := range state.Players {
+		if p.Presence != nil {
+			players = append(players, p)
+		}
+	}
+	sort.Slice(players, func(a, b int) bool {
+		return players[a].SlotNumber < players[b].SlotNumber
+	})
+	return players
+}
+
+func lobbySnapshot(state *LobbyMatchState) protocol.LobbyUpdate {
+	players := joinedPlayers(state)
+	dtos := make([]protocol.LobbyPlayer, 0, len(players))
+	for _, p := range players {
+		dtos = append(dtos, lobbyPlayerDto(p))
+	}
+
+	return protocol.LobbyUpdate{
+		Version:    protocol.Version,
+		Sequence:   state.Sequence,
+		Players:    dtos,
+		HostUserId: state.HostUserId,
+		Settings:   state.Settings,
+	}
+}
+
+// ensureHost hands the host role to the earliest joined player when the
+// current host isn't in the lobby, and reports whether the host changed.
+func ensureHost(state *LobbyMatchState) bool {
+	players := joinedPlayers(state)
+	for _, p := range players {
+		if p.UserId == state.HostUserId {
+			return false
+		}
+	}
+	if len(players) == 0 {
+		return false
+	}
+
+	state.HostUserId = players[0].UserId
+	return true
+}
+
+// sendLobbySnapshot sends the full roster to the given presences, such as a
+// player who just joined or asked to resync.
+func sendLobbySnapshot(logger runtime.Logger, state *LobbyMatchState, dispatcher runtime.MatchDispatcher, presences []runtime.Presence) {
+	if len(presences) == 0 {
+		return
+	}
+	send(logger, state, dispatcher, protocol.OP_LOBBY_UPDATE, lobbySnapshot(state), presences)
+}
+
+// broadcastLobbySnapshot is for changes that don't fit a delta, like everyone
+// being unreadied at once. It still takes a sequence number so clients can
+// tell it's newer than any delta they have.
+func broadcastLobbySnapshot(logger runtime.Logger, state *LobbyMatchState, dispatcher runtime.MatchDispatcher) {
+	state.Sequence++
+	send(logger, state, dispatcher, protocol.OP_LOBBY_UPDATE, lobbySnapshot(state), nil)
+}
+
+// publishLobbyEvents numbers the events and sends them to everyone in the
+// lobby except the skipped sessions. Clients that predate deltas get a single
+// full roster instead, as they always have.
+func publishLobbyEvents(logger runtime.Logger, state *LobbyMatchState, dispatcher runtime.MatchDispatcher, events []lobbyEvent, skip []runtime.Presence) {
+	if len(events) == 0 {
+		return
+	}
+
+	skipped := make(map[string]bool)
+	for _, p := range skip {
+		skipped[p.GetSessionId()] = true
+	}
+
+	deltaPresences := make([]runtime.Presence, 0)
+	legacyPresences := make([]runtime.Presence, 0)
+	for _, p := range joinedPlayers(state) {
+		if skipped[p.Presence.GetSessionId()] {
+			continue
+		}
+		if p.ProtocolVersion >= protocol.DeltaVersion {
+			deltaPresences = append(deltaPresences, p.Presence)
+		} else {
+			legacyPresences = append(legacyPresences, p.Presence)
+		}
+	}
+
+	for _, e := range events {
+		state.Sequence++
+		if len(deltaPresences) == 0 {
+			continue
+		}
+
+		delta := protocol.LobbyDelta{
+			Version:  protocol.Version,
+			Sequence: state.Sequence,
+			Event:    e.kind,
+			Player:   e.player,
+		}
+		send(logger, state, dispatcher, protocol.OP_LOBBY_DELTA, delta, deltaPresences)
+	}
+
+	sendLobbySnapshot(logger, state, dispatcher, legacyPresences)
+}
+
+// updateObserverFlags gives the first RequiredPlayerCount slots to players and makes everyone
+// else an observer, returning a moved event for every joined player whose role
+// changed.
+func updateObserverFlags(state *LobbyMatchState) []lobbyEvent {
+	// Players coming back to a recovered lobby got their role from the game
+	// when they reserved their slot
+	if state.Recovered {
+		return nil
+	}
+
+	players := values(state.Players)
+	sort.Slice(players, func(a, b int) bool {
+		return players[a].SlotNumber < players[b].SlotNumber
+	})
+
+	events := make([]lobbyEvent, 0)
+	for ix, p := range players {
+		wasObserving := p.IsObserving
+		p.IsObserving = ix >= state.RequiredPlayerCount
+		if p.IsObserving != wasObserving && p.Presence != nil {
+			events = append(events, newLobbyEvent(protocol.LobbyEventMoved, p))
+		}
+	}
+	return events
+}
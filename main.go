@@ -5,9 +5,14 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/heroiclabs/nakama-common/runtime"
+
+	"imps/mpserver/protocol"
 )
 
 var (
@@ -18,71 +23,382 @@ var (
 	errUnmarshal      = runtime.NewError("cannot unmarshal type", 13) // INTERNAL
 )
 
+var errAdminOnly = runtime.NewError("rpc is only callable server to server", 7) // PERMISSION_DENIED
+
 const (
-	rpcIdRewards   = "rewards"
-	rpcIdFindMatch = "find_match"
+	rpcIdRewards         = "rewards"
+	rpcIdFindMatch       = "find_match"
+	rpcIdAllocatorStatus = "allocator-status"
+	rpcIdGameEnded       = "game-ended"
+	rpcIdReloadGameModes = "reload-game-modes"
+	rpcIdSetMaintenance  = "set-maintenance"
+	rpcIdMaintenance     = "maintenance-status"
+	rpcIdResolveMatch    = "resolve-match"
 )
 
+// Open lobbies find_match looks through before giving up and creating one
+const findMatchListLimit = 100
+
+// requireServerToServer rejects rpcs made from a client session, since those
+// always carry a user ID.
+func requireServerToServer(ctx context.Context) error {
+	if _, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string); ok {
+		return errAdminOnly
+	}
+	return nil
+}
+
+// createLobby starts a LobbyMatch hosted by the given user and returns its
+// match ID.
+func createLobby(ctx context.Context, nk runtime.NakamaModule, userId string, username string, isPrivate bool, settings protocol.LobbySettings) (string, error) {
+	matchName := fmt.Sprintf("Play with %s", username)
+	users, _ := nk.UsersGetId(ctx, []string{userId}, nil)
+	if len(users) > 0 {
+		privateSuffix := ""
+		if isPrivate {
+			privateSuffix = " (Private)"
+		}
+		matchName = fmt.Sprintf("Play with %s%s", users[0].DisplayName, privateSuffix)
+	}
+
+	params := map[string]interface{}{
+		"isPrivate":  isPrivate,
+		"matchName":  matchName,
+		"hostUserId": userId,
+		"settings":   settings,
+	}
+	return nk.MatchCreate(ctx, "LobbyMatch", params)
+}
+
+// findMatch returns the first public lobby in the requested mode with a slot
+// left, or starts one when there is none. Lobbies that haven't launched stay
+// joinable once full, so it goes by the open slots in the label.
+func findMatch(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, userId string, username string, request FindMatchRequest) (string, error) {
+	modes := currentGameModes()
+	mode := request.mode(modes)
+
+	query := fmt.Sprintf("+label.mode:%s +label.canJoin:true +label.isPrivate:false +label.openSlots:>=1", mode)
+	matches, err := nk.MatchList(ctx, findMatchListLimit, true, "", nil, nil, query)
+	if err != nil {
+		logger.Error("unable to list lobbies for mode %s: %v", mode, err)
+		return "", errInternalError
+	}
+	if len(matches) > 0 {
+		return matches[0].MatchId, nil
+	}
+
+	settings := withDefaults(modes, protocol.LobbySettings{Mode: mode})
+	return createLobby(ctx, nk, userId, username, false, settings)
+}
+
+// resolveMatch is the resolve-match rpc. A lobby recovered after a restart
+// runs under a new match ID, so clients reconnecting to a game in progress
+// look up where the match ID they joined with went. IDs of lobbies that were
+// never recovered come back unchanged.
+func resolveMatch(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	if _, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string); !ok {
+		return "", errNoUserIdFound
+	}
+
+	var request ResolveMatchRequest
+	if err := decodePayload([]byte(payload), &request); err != nil {
+		return "", invalidArgument(err)
+	}
+
+	return matchIdResponse(logger, resolveMatchId(ctx, logger, nk, request.MatchId))
+}
+
+func matchIdResponse(logger runtime.Logger, matchId string) (string, error) {
+	response := map[string]interface{}{
+		"matchId": matchId,
+	}
+
+	bytes, err := json.Marshal(response)
+	if err != nil {
+		logger.Error("error marshaling response: %v", err)
+		return "", err
+	}
+
+	return string(bytes), nil
+}
+
 // noinspection GoUnusedExportedFunction
 func InitModule(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, initializer runtime.Initializer) error {
 	initStart := time.Now()
 
+	env, _ := ctx.Value(runtime.RUNTIME_CTX_ENV).(map[string]string)
+	config, err := loadLobbyConfig(env)
+	if err != nil {
+		logger.Error("invalid runtime env: %v", err)
+		return err
+	}
+	config.log(logger)
+
+	// Lobbies can't be created or validated without the game modes
+	if err := reloadGameModes(ctx, logger, nk, config.GameModesFile); err != nil {
+		logger.Error("unable to load game modes: %v", err)
+		return err
+	}
+
+	allocator := newServerAllocator(config.ServerManagers)
+	allocator.StartHealthChecks(context.Background(), logger, config.HealthCheckInterval)
+	queue := newAllocationQueue()
+	metrics := newLobbyMetrics(nk)
+
+	// Lobbies only emit events when there is somewhere to forward them
+	analytics := newLobbyAnalytics(nil)
+	if config.AnalyticsSink != "" {
+		// Already checked by loadLobbyConfig
+		sink, _ := newAnalyticsSink(config.AnalyticsSink)
+		forwarder := newAnalyticsForwarder(sink, config.AnalyticsBatchSize)
+		// Nakama stops on the same signals, then runs MatchTerminate and
+		// waits out its grace period, which the forwarder spends draining.
+		// Only the first signal matters, so the registration is released
+		// once it arrives.
+		stopping, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-stopping.Done()
+			stop()
+		}()
+		forwarder.Start(stopping, logger, config.AnalyticsFlushInterval)
+		if err := initializer.RegisterEvent(forwarder.handle); err != nil {
+			logger.Error("unable to register analytics event handler: %v", err)
+			return err
+		}
+		analytics = newLobbyAnalytics(nk)
+	}
+
 	if err := initializer.RegisterMatch("LobbyMatch", func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule) (runtime.Match, error) {
-		return &LobbyMatch{}, nil
+		var match runtime.Match = &LobbyMatch{config: config, allocator: allocator, queue: queue, metrics: metrics, analytics: analytics}
+		if config.RecordDir != "" {
+			match = newMatchRecorder(config, allocator, queue, metrics, analytics)
+		}
+		if config.CheckInvariants {
+			match = &invariantChecker{match}
+		}
+		return match, nil
+	}); err != nil {
+		return err
+	}
+
+	if err := initializer.RegisterMatch("AllocationReconciler", func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule) (runtime.Match, error) {
+		return &ReconcilerMatch{allocator: allocator}, nil
 	}); err != nil {
 		return err
 	}
 
 	if err := initializer.RegisterRpc("create-lobby", func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
-		// Assume the match will be public by default
-		isPrivate := false
-		matchName := fmt.Sprintf("Play with %s", ctx.Value(runtime.RUNTIME_CTX_USERNAME).(string))
+		userId, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+		if !ok {
+			return "", errNoUserIdFound
+		}
+		username, _ := ctx.Value(runtime.RUNTIME_CTX_USERNAME).(string)
 
-		userId := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
-		users, _ := nk.UsersGetId(ctx, []string{userId}, nil)
+		if window := currentMaintenance(ctx, logger, nk); window.Active {
+			return "", window.error()
+		}
+
+		// Every field is optional, so an empty payload creates a public lobby
+		var request CreateLobbyRequest
+		if err := decodePayload([]byte(payload), &request); err != nil {
+			return "", invalidArgument(err)
+		}
 
-		// Get the isPrivate value from the payload if it exists
-		var data map[string]interface{}
-		if err := json.Unmarshal([]byte(payload), &data); err != nil {
-			logger.Error("error unmarshaling payload: %v", err)
+		// Create the match and return the match ID to the player
+		matchId, err := createLobby(ctx, nk, userId, username, request.IsPrivate, request.settings(currentGameModes()))
+		if err != nil {
 			return "", err
 		}
 
-		if val, ok := data["isPrivate"]; ok {
-			isPrivate = val.(bool)
+		return matchIdResponse(logger, matchId)
+	}); err != nil {
+		logger.Error("unable to register create match rpc: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc(rpcIdFindMatch, func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+		userId, ok := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+		if !ok {
+			return "", errNoUserIdFound
 		}
-		if len(users) > 0 {
-			privateSuffix := ""
-			if isPrivate {
-				privateSuffix = " (Private)"
-			}
-			matchName = fmt.Sprintf("Play with %s%s", users[0].DisplayName, privateSuffix)
+		username, _ := ctx.Value(runtime.RUNTIME_CTX_USERNAME).(string)
+
+		// Open lobbies could still be joined, but they'll be gone before
+		// a game there could finish
+		if window := currentMaintenance(ctx, logger, nk); window.Active {
+			return "", window.error()
 		}
 
-		params := map[string]interface{}{
-			"isPrivate": isPrivate,
-			"matchName": matchName,
+		var request FindMatchRequest
+		if err := decodePayload([]byte(payload), &request); err != nil {
+			return "", invalidArgument(err)
 		}
 
-		// Create the match and return the match ID to the player
-		matchId, err := nk.MatchCreate(ctx, "LobbyMatch", params)
+		matchId, err := findMatch(ctx, logger, nk, userId, username, request)
 		if err != nil {
 			return "", err
 		}
 
-		response := map[string]interface{}{
-			"matchId": matchId,
+		return matchIdResponse(logger, matchId)
+	}); err != nil {
+		logger.Error("unable to register find match rpc: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc(rpcIdResolveMatch, resolveMatch); err != nil {
+		logger.Error("unable to register resolve match rpc: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc(rpcIdReloadGameModes, func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+		// Picks up a catalog edited in storage. Only the node that serves
+		// the call reloads, so call it on every node.
+		if err := requireServerToServer(ctx); err != nil {
+			return "", err
+		}
+		if payload != "" {
+			return "", errNoInputAllowed
+		}
+
+		if err := reloadGameModes(ctx, logger, nk, config.GameModesFile); err != nil {
+			logger.Error("unable to reload game modes: %v", err)
+			return "", invalidArgument(err)
 		}
 
-		bytes, err := json.Marshal(response)
+		bytes, err := json.Marshal(map[string]interface{}{
+			"modes": currentGameModes().modeNames(),
+		})
 		if err != nil {
-			logger.Error("error marshaling response: %v", err)
+			logger.Error("error marshaling game modes: %v", err)
+			return "", errMarshal
+		}
+
+		return string(bytes), nil
+	}); err != nil {
+		logger.Error("unable to register reload game modes rpc: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc(rpcIdAllocatorStatus, func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+		// Backend addresses are internal, so only expose them server to server
+		if err := requireServerToServer(ctx); err != nil {
 			return "", err
 		}
+		if payload != "" {
+			return "", errNoInputAllowed
+		}
+
+		bytes, err := json.Marshal(map[string]interface{}{
+			"backends":    allocator.Status(),
+			"queueLength": queue.Len(),
+		})
+		if err != nil {
+			logger.Error("error marshaling allocator status: %v", err)
+			return "", errMarshal
+		}
 
 		return string(bytes), nil
 	}); err != nil {
-		logger.Error("unable to register create match rpc: %v", err)
+		logger.Error("unable to register allocator status rpc: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc(rpcIdGameEnded, func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+		// Called by game servers when a game finishes
+		if err := requireServerToServer(ctx); err != nil {
+			return "", err
+		}
+
+		var request GameEndedRequest
+		if err := decodePayload([]byte(payload), &request); err != nil {
+			return "", invalidArgument(err)
+		}
+
+		// The lobby may have been recovered under a new match ID since the
+		// game server was allocated
+		matchId := resolveMatchId(ctx, logger, nk, request.MatchId)
+		if _, err := nk.MatchSignal(ctx, matchId, signalGameEnded); err != nil {
+			logger.Error("unable to signal game end to match %s: %v", matchId, err)
+			return "", err
+		}
+
+		return "{}", nil
+	}); err != nil {
+		logger.Error("unable to register game ended rpc: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc(rpcIdSetMaintenance, func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+		// Turns maintenance on ahead of a deploy, or off again
+		if err := requireServerToServer(ctx); err != nil {
+			return "", err
+		}
+
+		var request SetMaintenanceRequest
+		if err := decodePayload([]byte(payload), &request); err != nil {
+			return "", invalidArgument(err)
+		}
+
+		window := request.window(time.Now())
+		if err := setMaintenance(ctx, nk, window); err != nil {
+			logger.Error("unable to set maintenance: %v", err)
+			return "", errInternalError
+		}
+		notified, err := notifyLobbies(ctx, logger, nk, window)
+		if err != nil {
+			logger.Error("unable to tell lobbies about maintenance: %v", err)
+			return "", errInternalError
+		}
+		logger.Info("maintenance %+v set, %d lobbies told", window, notified)
+
+		bytes, err := json.Marshal(map[string]interface{}{
+			"maintenance":     window,
+			"lobbiesNotified": notified,
+		})
+		if err != nil {
+			logger.Error("error marshaling maintenance: %v", err)
+			return "", errMarshal
+		}
+
+		return string(bytes), nil
+	}); err != nil {
+		logger.Error("unable to register set maintenance rpc: %v", err)
+		return err
+	}
+
+	if err := initializer.RegisterRpc(rpcIdMaintenance, func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+		// Doesn't need a session, so clients can show the maintenance window
+		// before players log in
+		if payload != "" {
+			return "", errNoInputAllowed
+		}
+
+		window := currentMaintenance(ctx, logger, nk)
+		bytes, err := json.Marshal(map[string]interface{}{
+			"active":          window.Active,
+			"message":         window.Message,
+			"startsAt":        window.StartsAt,
+			"endsAt":          window.EndsAt,
+			"startsInSeconds": newMaintenanceNotice(window, time.Now()).StartsInSeconds,
+		})
+		if err != nil {
+			logger.Error("error marshaling maintenance status: %v", err)
+			return "", errMarshal
+		}
+
+		return string(bytes), nil
+	}); err != nil {
+		logger.Error("unable to register maintenance status rpc: %v", err)
+		return err
+	}
+
+	if err := recoverLobbies(ctx, logger, nk, config.SnapshotMaxAge); err != nil {
+		logger.Error("unable to recover lobbies: %v", err)
+		return err
+	}
+
+	if err := startReconciler(ctx, logger, nk); err != nil {
+		logger.Error("unable to start reconciler: %v", err)
 		return err
 	}
 
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+
+	"imps/mpserver/nakamatest"
+	"imps/mpserver/protocol"
+)
+
+func TestFindMatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		players int
+		leaving int
+		// Whether find_match should send the player to the existing lobby
+		wantExisting bool
+	}{
+		{name: "lobby with room", players: 1, wantExisting: true},
+		{name: "only lobby is full", players: 2},
+		{name: "full lobby someone left", players: 2, leaving: 1, wantExisting: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newLobbyHarness(t, nil)
+			h.init("host", protocol.LobbySettings{})
+			var players []*nakamatest.Presence
+			for i := 0; i < tt.players; i++ {
+				p := h.nk.AddUser(string(rune('a'+i)), "Player")
+				h.join(p, deltaClient)
+				players = append(players, p)
+			}
+			for _, p := range players[:tt.leaving] {
+				h.leave(p)
+			}
+			h.nk.AddMatch(h.lobby().MatchId, h.dispatcher.Label(), len(h.lobby().Players))
+
+			matchId, err := findMatch(h.ctx, h.logger, h.nk, "seeker", "Seeker", FindMatchRequest{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantExisting {
+				if matchId != h.lobby().MatchId || len(h.nk.Created) != 0 {
+					t.Errorf("found %s and created %d lobbies, want %s", matchId, len(h.nk.Created), h.lobby().MatchId)
+				}
+			} else if len(h.nk.Created) != 1 || matchId != h.nk.Created[0].MatchId {
+				t.Errorf("found %s, want a new lobby (created %+v)", matchId, h.nk.Created)
+			}
+		})
+	}
+}
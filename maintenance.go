@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+
+	"imps/mpserver/protocol"
+)
+
+// Maintenance mode drains the server ahead of a deploy. While it is on no new
+// lobbies are created, lobbies that haven't launched are told when the server
+// goes down, and games in progress carry on, since their lobbies come back
+// after the restart. The window lives in storage so every node sees it, and
+// each node caches it for maintenanceCacheTTL.
+const (
+	// Kept alongside the game modes in the config collection
+	maintenanceKey      = "maintenance"
+	maintenanceCacheTTL = 10 * time.Second
+	// Lobbies set-maintenance tells about the window
+	maintenanceSignalLimit = 1000
+	// Sent through MatchSignal followed by the lobby's maintenanceNotice
+	signalMaintenance = "maintenance:"
+)
+
+// maintenanceWindow is what set-maintenance stores. StartsAt and EndsAt are
+// Unix seconds, and EndsAt is only an estimate for players.
+type maintenanceWindow struct {
+	Active   bool   `json:"active"`
+	Message  string `json:"message"`
+	StartsAt int64  `json:"startsAt"`
+	EndsAt   int64  `json:"endsAt,omitempty"`
+}
+
+// startsIn is how long until the server goes down, or zero once it's due.
+// Countdowns round it up, like the lobby's ticks do.
+func (w maintenanceWindow) startsIn(now time.Time) time.Duration {
+	if d := time.Unix(w.StartsAt, 0).Sub(now); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// error is what create-lobby and find_match refuse with while maintenance is
+// on.
+func (w maintenanceWindow) error() error {
+	message := "server is down for maintenance, no new games can be started"
+	if w.Message != "" {
+		message += ": " + w.Message
+	}
+	return runtime.NewError(message, 14) // UNAVAILABLE
+}
+
+type SetMaintenanceRequest struct {
+	Active  bool   `json:"active"`
+	Message string `json:"message"`
+	// How long lobbies that haven't launched have before the server goes
+	// down. Zero means now.
+	StartsInSeconds int `json:"startsInSeconds"`
+	// How long the server is expected to be down for, if known
+	DurationSeconds int `json:"durationSeconds"`
+}
+
+const maxMaintenanceMessageLength = 500
+
+func (r *SetMaintenanceRequest) validate(errs *fieldErrors) {
+	if r.StartsInSeconds < 0 {
+		errs.add("startsInSeconds", "must not be negative")
+	}
+	if r.DurationSeconds < 0 {
+		errs.add("durationSeconds", "must not be negative")
+	}
+	if len(r.Message) > maxMaintenanceMessageLength {
+		errs.add("message", "must be at most %d bytes", maxMaintenanceMessageLength)
+	}
+	if !r.Active && (r.Message != "" || r.StartsInSeconds != 0 || r.DurationSeconds != 0) {
+		errs.add("active", "must be true to schedule maintenance")
+	}
+}
+
+func (r *SetMaintenanceRequest) window(now time.Time) maintenanceWindow {
+	if !r.Active {
+		return maintenanceWindow{}
+	}
+	startsAt := now.Add(time.Duration(r.StartsInSeconds) * time.Second)
+	window := maintenanceWindow{Active: true, Message: r.Message, StartsAt: startsAt.Unix()}
+	if r.DurationSeconds > 0 {
+		window.EndsAt = startsAt.Add(time.Duration(r.DurationSeconds) * time.Second).Unix()
+	}
+	return window
+}
+
+// The window as last read from storage. A node that fails to read it keeps
+// using what it had, which is off until the first read succeeds.
+var (
+	maintenanceMu      sync.Mutex
+	maintenance        maintenanceWindow
+	maintenanceFetched time.Time
+)
+
+// currentMaintenance returns the window, reading it from storage when the
+// cached copy is older than maintenanceCacheTTL.
+func currentMaintenance(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule) maintenanceWindow {
+	maintenanceMu.Lock()
+	defer maintenanceMu.Unlock()
+
+	if time.Since(maintenanceFetched) < maintenanceCacheTTL {
+		return maintenance
+	}
+	window, err := readMaintenance(ctx, nk)
+	if err != nil {
+		logger.Warn("unable to read maintenance window, keeping the cached one: %v", err)
+		return maintenance
+	}
+	maintenance = window
+	maintenanceFetched = time.Now()
+	return maintenance
+}
+
+func readMaintenance(ctx context.Context, nk runtime.NakamaModule) (maintenanceWindow, error) {
+	var window maintenanceWindow
+	objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{
+		Collection: gameModesCollection,
+		Key:        maintenanceKey,
+		UserID:     systemUserId,
+	}})
+	if err != nil || len(objects) == 0 {
+		return window, err
+	}
+	if err := json.Unmarshal([]byte(objects[0].GetValue()), &window); err != nil {
+		return window, fmt.Errorf("decoding maintenance window: %w", err)
+	}
+	return window, nil
+}
+
+// setMaintenance stores the window and puts it in use on this node straight
+// away. Other nodes pick it up when their cache expires.
+func setMaintenance(ctx context.Context, nk runtime.NakamaModule, window maintenanceWindow) error {
+	bytes, err := json.Marshal(window)
+	if err != nil {
+		return err
+	}
+	if _, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{{
+		Collection:      gameModesCollection,
+		Key:             maintenanceKey,
+		UserID:          systemUserId,
+		Value:           string(bytes),
+		PermissionRead:  runtime.STORAGE_PERMISSION_NO_READ,
+		PermissionWrite: runtime.STORAGE_PERMISSION_NO_WRITE,
+	}}); err != nil {
+		return fmt.Errorf("writing maintenance window: %w", err)
+	}
+
+	maintenanceMu.Lock()
+	maintenance = window
+	maintenanceFetched = time.Now()
+	maintenanceMu.Unlock()
+	return nil
+}
+
+// maintenanceNotice is the signal a lobby gets about the window. The time
+// left is worked out before sending, so the lobby can count down in ticks
+// without reading the clock.
+type maintenanceNotice struct {
+	Active          bool   `json:"active"`
+	Message         string `json:"message"`
+	StartsInSeconds int    `json:"startsInSeconds"`
+}
+
+func newMaintenanceNotice(window maintenanceWindow, now time.Time) maintenanceNotice {
+	return maintenanceNotice{
+		Active:          window.Active,
+		Message:         window.Message,
+		StartsInSeconds: int((window.startsIn(now) + time.Second - 1) / time.Second),
+	}
+}
+
+// notifyLobbies signals the window to every lobby that hasn't launched, and
+// returns how many were told. Lobbies that can't be signalled are logged and
+// skipped, since MatchTerminate still warns their players when the server
+// goes down.
+func notifyLobbies(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, window maintenanceWindow) (int, error) {
+	bytes, err := json.Marshal(newMaintenanceNotice(window, time.Now()))
+	if err != nil {
+		return 0, err
+	}
+
+	matches, err := nk.MatchList(ctx, maintenanceSignalLimit, true, "", nil, nil, "+label.canJoin:true")
+	if err != nil {
+		return 0, fmt.Errorf("listing lobbies: %w", err)
+	}
+
+	notified := 0
+	for _, match := range matches {
+		if _, err := nk.MatchSignal(ctx, match.MatchId, signalMaintenance+string(bytes)); err != nil {
+			logger.Warn("unable to tell match %s about maintenance: %v", match.MatchId, err)
+			continue
+		}
+		notified++
+	}
+	return notified, nil
+}
+
+// parseMaintenanceSignal decodes a signal sent by notifyLobbies, reporting
+// false for any other signal.
+func parseMaintenanceSignal(data string) (maintenanceNotice, bool, error) {
+	var notice maintenanceNotice
+	if !strings.HasPrefix(data, signalMaintenance) {
+		return notice, false, nil
+	}
+	err := json.Unmarshal([]byte(strings.TrimPrefix(data, signalMaintenance)), &notice)
+	return notice, true, err
+}
+
+// maintenanceBanner is the lobby's countdown as of tick.
+func maintenanceBanner(config *LobbyConfig, state *LobbyMatchState, tick int64) protocol.Maintenance {
+	startsIn := int64(0)
+	if left := state.MaintenanceTick - tick; left > 0 {
+		tickRate := int64(config.TickRate)
+		startsIn = (left + tickRate - 1) / tickRate
+	}
+	return protocol.Maintenance{
+		Version:         protocol.Version,
+		Active:          state.Maintenance,
+		Message:         state.MaintenanceMessage,
+		StartsInSeconds: int(startsIn),
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"imps/mpserver/nakamatest"
+	"imps/mpserver/protocol"
+)
+
+// resetMaintenance forgets the cached window once the test is done, so it
+// doesn't leak into the next one.
+func resetMaintenance(t *testing.T) {
+	t.Cleanup(func() {
+		maintenanceMu.Lock()
+		maintenance = maintenanceWindow{}
+		maintenanceFetched = time.Time{}
+		maintenanceMu.Unlock()
+	})
+}
+
+func TestSetMaintenance(t *testing.T) {
+	resetMaintenance(t)
+	ctx := context.Background()
+	logger := nakamatest.NewLogger(t)
+	nk := nakamatest.NewNakamaModule()
+	nk.AddMatch("open.node", `{"canJoin":"true"}`, 1)
+
+	if window := currentMaintenance(ctx, logger, nk); window.Active {
+		t.Fatalf("maintenance on before it was set: %+v", window)
+	}
+
+	request := SetMaintenanceRequest{Active: true, Message: "Deploying 1.2", StartsInSeconds: 300, DurationSeconds: 600}
+	window := request.window(time.Now())
+	if err := setMaintenance(ctx, nk, window); err != nil {
+		t.Fatal(err)
+	}
+	if notified, err := notifyLobbies(ctx, logger, nk, window); err != nil || notified != 1 {
+		t.Fatalf("notified %d lobbies: %v", notified, err)
+	}
+
+	signals := nk.Signals["open.node"]
+	if len(signals) != 1 {
+		t.Fatalf("lobby got signals %q", signals)
+	}
+	notice, ok, err := parseMaintenanceSignal(signals[0])
+	if !ok || err != nil || !notice.Active || notice.Message != "Deploying 1.2" || notice.StartsInSeconds != 300 {
+		t.Errorf("lobby was signalled %+v, %v, %v", notice, ok, err)
+	}
+
+	// Another node reads it from storage
+	stored, err := readMaintenance(ctx, nk)
+	if err != nil || stored != window {
+		t.Errorf("stored window = %+v, %v, want %+v", stored, err, window)
+	}
+	if stored.EndsAt-stored.StartsAt != 600 {
+		t.Errorf("window lasts %ds", stored.EndsAt-stored.StartsAt)
+	}
+	if err := currentMaintenance(ctx, logger, nk).error(); !strings.Contains(err.Error(), "Deploying 1.2") {
+		t.Errorf("refusal = %v", err)
+	}
+}
+
+func TestLobbyMaintenance(t *testing.T) {
+	signal := func(active bool, startsIn int) string {
+		now := time.Now()
+		window := maintenanceWindow{}
+		if active {
+			window = maintenanceWindow{Active: true, Message: "Back soon", StartsAt: now.Unix() + int64(startsIn)}
+		}
+		bytes, _ := json.Marshal(newMaintenanceNotice(window, time.Unix(now.Unix(), 0)))
+		return signalMaintenance + string(bytes)
+	}
+
+	t.Run("waiting lobby counts down", func(t *testing.T) {
+		h := newLobbyHarness(t, nil)
+		h.init("host", protocol.LobbySettings{})
+		host := h.nk.AddUser("host", "Host")
+		h.join(host, deltaClient)
+
+		h.signal(signal(true, 60))
+		banners := received[protocol.Maintenance](h, host, protocol.OP_MAINTENANCE)
+		if len(banners) != 1 || !banners[0].Active || banners[0].Message != "Back soon" || banners[0].StartsInSeconds != 60 {
+			t.Fatalf("host got banners %+v", banners)
+		}
+
+		// Players joining later see how long is left
+		for i := int64(0); i < h.config.ticks(20*time.Second); i++ {
+			h.loop()
+		}
+		guest := h.nk.AddUser("guest", "Guest")
+		h.join(guest, deltaClient)
+		banners = received[protocol.Maintenance](h, guest, protocol.OP_MAINTENANCE)
+		if len(banners) != 1 || banners[0].StartsInSeconds != 40 {
+			t.Errorf("guest got banners %+v", banners)
+		}
+
+		h.dispatcher.Reset()
+		h.signal(signal(false, 0))
+		banners = received[protocol.Maintenance](h, guest, protocol.OP_MAINTENANCE)
+		if len(banners) != 1 || banners[0].Active {
+			t.Errorf("called off maintenance sent banners %+v", banners)
+		}
+	})
+
+	t.Run("game in progress carries on", func(t *testing.T) {
+		h, host, _ := launchedLobby(t)
+		h.dispatcher.Reset()
+
+		h.signal(signal(true, 60))
+		if banners := received[protocol.Maintenance](h, host, protocol.OP_MAINTENANCE); len(banners) != 0 {
+			t.Errorf("players in a game got banners %+v", banners)
+		}
+		if h.lobby().GameState != InProgress {
+			t.Errorf("game state = %v", h.lobby().GameState)
+		}
+	})
+}
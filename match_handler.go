@@ -1,29 +1,44 @@
 package main
 
 import (
-	"bytes"
 	"database/sql"
 	"encoding/json"
-	"io/ioutil"
-	"net/http"
+	"errors"
+	"sort"
 	"strconv"
+	"time"
 
 	"context"
-	"sort"
 
 	"github.com/heroiclabs/nakama-common/api"
 	"github.com/heroiclabs/nakama-common/runtime"
 	"github.com/thoas/go-funk"
+
+	"imps/mpserver/protocol"
 )
 
-const tickRate int = 10
-const maxEmptyTicks int = tickRate * 10 // tickRate * seconds
+type LobbyMatch struct {
+	config    *LobbyConfig
+	allocator lobbyAllocator
+	queue     lobbyQueue
+	metrics   *lobbyMetrics
+	analytics *lobbyAnalytics
+}
+
+// lobbyAllocator and lobbyQueue are the parts of ServerAllocator and
+// AllocationQueue a lobby uses, so a recording can stand in for them when a
+// session is replayed.
+type lobbyAllocator interface {
+	Allocate(matchId string, region string, settings protocol.LobbySettings) (*gameServerAllocation, error)
+	HasCapacity() bool
+	ReleaseInBackground(logger runtime.Logger, backend string, serverId string)
+}
 
-const OP_READY = 1
-const OP_LOBBY_UPDATE = 2
-const OP_GAME_START = 3
+type lobbyQueue interface {
+	Enqueue(matchId string) int
+	Remove(matchId string)
+}
 
-type LobbyMatch struct{}
 type GameState int
 
 type LobbyMatchState struct {
@@ -39,15 +54,61 @@ type LobbyMatchState struct {
 	MatchName           string
 	CanJoin             bool
 	MatchId             string
+	Region              string
+	QueuePosition       int
+	NextAllocation      int64
+	ServerId            string
+	ServerBackend       string
+	// Sequence number of the last roster change sent to clients
+	Sequence     int64
+	HostUserId   string
+	MutedUserIds map[string]bool
+	ChatHistory  []protocol.ChatMessage
+	Settings     protocol.LobbySettings
+	Ranked       bool
+	// The match ID the lobby was created with. It stays the same when the
+	// lobby is recovered under a new one after a restart, see snapshot.go.
+	OriginalMatchId string
+	// What the server manager said about the game server, for players who
+	// join once the game is in progress
+	ServerResponse []byte
+	Recovered      bool
+	// For recovered lobbies, the users who were in the game and whether each
+	// was observing. Nobody else may join, and everyone keeps their role.
+	Participants map[string]bool
+	// Set by MatchTerminate for the grace period before the server stops
+	ShuttingDown bool
+	// Set once the lobby has been reported as ended, which MatchTerminate
+	// does for lobbies that won't be back after the restart
+	EndReported bool
+	// When everyone was last ready, for the ready-to-launch metric
+	ReadyTick int64
+	// Planned maintenance the lobby has been told about, with the tick the
+	// server goes down at, see maintenance.go
+	Maintenance        bool
+	MaintenanceMessage string
+	MaintenanceTick    int64
 }
 
 type PlayerState struct {
-	Presence    runtime.Presence
+	// Not serialized, since it can't be decoded again
+	Presence    runtime.Presence `json:"-"`
 	IsReady     bool
 	SlotNumber  int
 	IsObserving bool
 	DisplayName string
 	UserId      string
+	Latencies   map[string]int
+	// Negotiated from the join metadata
+	ProtocolVersion int
+	Encoding        string
+	BlockedUserIds  map[string]bool
+	// For the durations in analytics events
+	JoinedTick int64
+	// Flood protection, see allowMessage
+	RateLimits        map[int64]*tokenBucket
+	Violations        int
+	LastViolationTick int64
 }
 
 const (
@@ -55,32 +116,133 @@ const (
 	WaitingForPlayersReady GameState = 1
 	Launching              GameState = 2 // Get rid of this
 	InProgress             GameState = 3
+	WaitingForServer       GameState = 4
+	Ended                  GameState = 5
 )
 
-func toJson(thing interface{}) string {
-	ret, err := json.Marshal(thing)
+// Sent through MatchSignal by the game-ended rpc once the game server is done
+const signalGameEnded = "game_ended"
+
+func getLabel(state *LobbyMatchState) (string, error) {
+	label := protocol.LobbyLabel{
+		Version:     protocol.Version,
+		IsPrivate:   strconv.FormatBool(state.IsPrivate),
+		PlayerCount: state.PlayerCount,
+		MatchName:   state.MatchName,
+		CanJoin:     strconv.FormatBool(state.CanJoin),
+		OpenSlots:   state.RequiredPlayerCount + state.AllowedObservers - len(state.Players),
+		Region:      state.Region,
+		Mode:        state.Settings.Mode,
+		Map:         state.Settings.Map,
+		TimeLimit:   state.Settings.TimeLimit,
+		Ranked:      strconv.FormatBool(state.Ranked),
+	}
+	bytes, err := json.Marshal(label)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
-	return string(ret)
+	return string(bytes), nil
 }
 
-func toJsonBytes(thing interface{}) []byte {
-	ret, err := json.Marshal(thing)
+func updateLabel(logger runtime.Logger, state *LobbyMatchState, dispatcher runtime.MatchDispatcher) {
+	label, err := getLabel(state)
 	if err != nil {
-		panic(err)
+		logger.Error("unable to build label for match %s: %v", state.MatchId, err)
+		return
+	}
+	if err := dispatcher.MatchLabelUpdate(label); err != nil {
+		logger.Error("unable to update label for match %s: %v", state.MatchId, err)
+	}
+}
+
+// Every encoding a message may need to be sent in, in the order they are sent
+var encodings = []string{protocol.EncodingJSON, protocol.EncodingProtobuf}
+
+func encode(msg protocol.Message, encoding string) ([]byte, error) {
+	if encoding == protocol.EncodingProtobuf {
+		return msg.MarshalProto()
+	}
+	return json.Marshal(msg)
+}
+
+// send delivers msg to the given presences, or to everyone in the lobby if
+// presences is nil. Recipients are grouped by the encoding and protocol
+// version they negotiated, and each group gets the message stamped with its
+// version in its own broadcast. Without a state to look players up in,
+// everyone gets the message as built, in JSON. Failures are logged rather
+// than returned, since a message that can't be delivered shouldn't take the
+// lobby down with it.
+func send(logger runtime.Logger, state *LobbyMatchState, dispatcher runtime.MatchDispatcher, opCode int64, msg protocol.Message, presences []runtime.Presence) {
+	type audience struct {
+		encoding string
+		version  int
+	}
+	recipients := make(map[audience][]runtime.Presence)
+	if state == nil {
+		recipients[audience{protocol.EncodingJSON, 0}] = presences
+	} else {
+		if presences == nil {
+			for _, p := range state.Players {
+				if p.Presence != nil {
+					presences = append(presences, p.Presence)
+				}
+			}
+		}
+		for _, p := range presences {
+			a := audience{protocol.EncodingJSON, 0}
+			if player, ok := state.Players[p.GetSessionId()]; ok {
+				if player.Encoding != "" {
+					a.encoding = player.Encoding
+				}
+				a.version = player.ProtocolVersion
+			}
+			recipients[a] = append(recipients[a], p)
+		}
+	}
+
+	audiences := make([]audience, 0, len(recipients))
+	for _, encoding := range encodings {
+		first := len(audiences)
+		for a := range recipients {
+			if a.encoding == encoding {
+				audiences = append(audiences, a)
+			}
+		}
+		group := audiences[first:]
+		sort.Slice(group, func(i, j int) bool { return group[i].version < group[j].version })
+	}
+
+	for _, a := range audiences {
+		stamped := msg
+		if a.version != 0 {
+			stamped = msg.ForVersion(a.version)
+		}
+		bytes, err := encode(stamped, a.encoding)
+		if err != nil {
+			logger.Error("unable to encode message with opcode %d as %s version %d: %v", opCode, a.encoding, a.version, err)
+			continue
+		}
+		if err := dispatcher.BroadcastMessage(opCode, bytes, recipients[a], nil, true); err != nil {
+			logger.Error("unable to send message with opcode %d: %v", opCode, err)
+		}
 	}
-	return ret
 }
 
-func getLabel(state *LobbyMatchState) string {
-	label := map[string]interface{}{
-		"isPrivate":   strconv.FormatBool(state.IsPrivate),
-		"playerCount": state.PlayerCount,
-		"matchName":   state.MatchName,
-		"canJoin":     strconv.FormatBool(state.CanJoin),
+func sendError(logger runtime.Logger, state *LobbyMatchState, dispatcher runtime.MatchDispatcher, presences []runtime.Presence, code string, message string) {
+	dto := protocol.ErrorMessage{
+		Version: protocol.Version,
+		Code:    code,
+		Message: message,
 	}
-	return toJson(label)
+	send(logger, state, dispatcher, protocol.OP_ERROR, dto, presences)
+}
+
+// abortCorruptLobby is the way out when a handler gets state it can't make
+// sense of. Players are told the lobby is closing, then returning nil ends it.
+func abortCorruptLobby(logger runtime.Logger, dispatcher runtime.MatchDispatcher, stateInterface interface{}) interface{} {
+	logger.Error("ending lobby with invalid state of type %T: %+v", stateInterface, stateInterface)
+	sendError(logger, nil, dispatcher, nil, protocol.ErrorCodeLobbyClosed, "The lobby hit an unrecoverable error and has closed")
+	return nil
 }
 
 func values[M ~map[K]V, K comparable, V any](m M) []V {
@@ -91,114 +253,268 @@ func values[M ~map[K]V, K comparable, V any](m M) []V {
 	return r
 }
 
-func updateObserverFlags(state *LobbyMatchState) {
-	players := values(state.Players)
-	sort.Slice(players, func(a, b int) bool {
-		return players[a].SlotNumber < players[b].SlotNumber
-	})
+// gameStartedDto passes along whatever the server manager told us, plus the
+// region the server is in.
+func gameStartedDto(state *LobbyMatchState, responseBytes []byte) (*protocol.GameStart, error) {
+	if !json.Valid(responseBytes) {
+		return nil, errors.New("allocation response is not valid JSON")
+	}
+	return &protocol.GameStart{
+		Version: protocol.Version,
+		Region:  state.Region,
+		Server:  responseBytes,
+	}, nil
+}
 
-	for ix, p := range players {
-		p.IsObserving = ix >= 2
+func broadcastQueuePosition(logger runtime.Logger, state *LobbyMatchState, dispatcher runtime.MatchDispatcher) {
+	dto := protocol.QueuePosition{
+		Version:  protocol.Version,
+		Position: state.QueuePosition,
 	}
+	send(logger, state, dispatcher, protocol.OP_QUEUE_POSITION, dto, nil)
 }
 
-func broadcastLobbyUpdate(logger runtime.Logger, state *LobbyMatchState, dispatcher runtime.MatchDispatcher) {
-	players := funk.Filter(values(state.Players), func(p *PlayerState) bool {
-		return p.Presence != nil
-	})
-
-	playerDtos := funk.Map(players, func(p *PlayerState) map[string]interface{} {
-		return map[string]interface{}{
-			"sessionId":   p.Presence.GetSessionId(),
-			"isObserving": p.IsObserving,
-			"isReady":     p.IsReady,
-			"displayName": p.DisplayName,
-			"userId":      p.Presence.GetUserId(),
+func countReadyPlayers(state *LobbyMatchState) int {
+	readyCount := 0
+	for _, p := range state.Players {
+		if !p.IsObserving && p.IsReady {
+			readyCount++
 		}
-	})
-	lobbyDto := map[string]interface{}{
-		"players": playerDtos,
-	}
-	bytes, err := json.Marshal(lobbyDto)
-	if err != nil {
-		panic(err)
 	}
-	logger.Info(string(bytes))
+	return readyCount
+}
 
-	err = dispatcher.BroadcastMessage(OP_LOBBY_UPDATE, bytes, nil, nil, true)
-	if err != nil {
-		panic(err)
+// updateWaitingState moves a lobby that hasn't started launching between
+// waiting for players and waiting for them to ready up as players come and go.
+func updateWaitingState(state *LobbyMatchState) {
+	if state.GameState != WaitingForPlayers && state.GameState != WaitingForPlayersReady {
+		return
+	}
+	if state.PlayerCount >= state.RequiredPlayerCount {
+		state.GameState = WaitingForPlayersReady
+	} else {
+		state.GameState = WaitingForPlayers
 	}
 }
 
-func broadcastGameStarted(logger runtime.Logger, state *LobbyMatchState, dispatcher runtime.MatchDispatcher, responseBytes []byte) {
-	err := dispatcher.BroadcastMessage(OP_GAME_START, responseBytes, nil, nil, true)
-	if err != nil {
-		panic(err)
+// waitForServer parks the lobby in the allocation queue, letting players know
+// whenever their place in line changes.
+func waitForServer(logger runtime.Logger, state *LobbyMatchState, dispatcher runtime.MatchDispatcher, position int) {
+	state.GameState = WaitingForServer
+	if state.QueuePosition != position+1 {
+		state.QueuePosition = position + 1
+		broadcastQueuePosition(logger, state, dispatcher)
 	}
 }
 
-func spinUpServer(matchId string) ([]byte, error) {
-	jsonBytes, err := json.Marshal(map[string]interface{}{"matchId": matchId})
-	if err != nil {
-		return nil, err
+// launch requests a game server for the lobby. Lobbies take turns through the
+// shared allocation queue, so only the lobby at the front may ask for one, and
+// while it waits for capacity it only retries once the allocator reports free
+// capacity again or the retry interval runs out.
+func (m *LobbyMatch) launch(logger runtime.Logger, state *LobbyMatchState, dispatcher runtime.MatchDispatcher, tick int64) {
+	position := m.queue.Enqueue(state.MatchId)
+	if position > 0 {
+		waitForServer(logger, state, dispatcher, position)
+		return
+	}
+	if state.GameState == WaitingForServer && tick < state.NextAllocation && !m.allocator.HasCapacity() {
+		waitForServer(logger, state, dispatcher, position)
+		return
 	}
 
-	address := "http://172.21.214.52:5000/GameServer"
-	address = "http://localhost:5000/GameServer"
-	address = "http://servermanager:5000/GameServer"
-	resp, err := http.Post(address, "application/json", bytes.NewBuffer(jsonBytes))
+	activePlayers := funk.Filter(values(state.Players), func(p *PlayerState) bool {
+		return !p.IsObserving
+	}).([]*PlayerState)
+	region := selectRegion(m.config.Regions, activePlayers)
+
+	started := time.Now()
+	server, err := m.allocator.Allocate(state.MatchId, region, state.Settings)
+	m.metrics.allocated(state, region, time.Since(started))
+	if errors.Is(err, errCapacityExhausted) {
+		logger.Info("no game server capacity for match %s, waiting in queue", state.MatchId)
+		m.metrics.allocationFailed(state, region, allocationErrorExhausted)
+		state.NextAllocation = tick + m.config.ticks(m.config.AllocationRetry)
+		waitForServer(logger, state, dispatcher, position)
+		return
+	}
+	m.queue.Remove(state.MatchId)
 	if err != nil {
-		println("Error during post")
-		return nil, err
+		logger.Error("unable to allocate game server for match %s: %v", state.MatchId, err)
+		m.metrics.allocationFailed(state, region, allocationErrorFailed)
+		m.analytics.emit(logger, eventLaunchFailed, state, "", m.config.duration(tick-state.ReadyTick), map[string]string{"reason": allocationErrorFailed})
+		m.abortLaunch(logger, state, dispatcher)
+		return
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
+	state.Region = region
+	state.ServerId = server.ServerId
+	state.ServerBackend = server.Backend
+	state.ServerResponse = server.Response
+
+	dto, err := gameStartedDto(state, server.Response)
 	if err != nil {
-		return nil, err
+		logger.Error("unable to read game server allocation for match %s: %v", state.MatchId, err)
+		m.metrics.allocationFailed(state, region, allocationErrorBadResponse)
+		m.analytics.emit(logger, eventLaunchFailed, state, "", m.config.duration(tick-state.ReadyTick), map[string]string{"reason": allocationErrorBadResponse})
+		m.releaseServer(logger, state)
+		state.Region = ""
+		m.abortLaunch(logger, state, dispatcher)
+		return
 	}
 
-	return body, nil
+	state.GameState = InProgress
+	state.CanJoin = false
+	state.QueuePosition = 0
+	updateLabel(logger, state, dispatcher)
+	m.metrics.launched(state, m.config.duration(tick-state.ReadyTick))
+	m.analytics.emit(logger, eventLaunched, state, "", m.config.duration(tick-state.ReadyTick), nil)
+
+	send(logger, state, dispatcher, protocol.OP_GAME_START, dto, nil)
+}
+
+// abortLaunch sends the lobby back to waiting for players after a launch
+// fails. Everyone has to ready up again so a broken allocator isn't retried
+// every tick.
+func (m *LobbyMatch) abortLaunch(logger runtime.Logger, state *LobbyMatchState, dispatcher runtime.MatchDispatcher) {
+	for _, p := range state.Players {
+		p.IsReady = false
+	}
+	state.GameState = WaitingForPlayersReady
+	state.QueuePosition = 0
+	updateWaitingState(state)
+
+	sendError(logger, state, dispatcher, nil, protocol.ErrorCodeLaunchFailed, "Unable to start a game server, please ready up to try again")
+	broadcastLobbySnapshot(logger, state, dispatcher)
+}
+
+// releaseServer hands the lobby's game server back to its backend, if it has
+// one. It is safe to call more than once.
+func (m *LobbyMatch) releaseServer(logger runtime.Logger, state *LobbyMatchState) {
+	if state.ServerBackend == "" {
+		return
+	}
+
+	if state.ServerId == "" {
+		logger.Warn("cannot release game server for match %s, server manager gave no server ID", state.MatchId)
+	} else {
+		m.allocator.ReleaseInBackground(logger, state.ServerBackend, state.ServerId)
+	}
+	state.ServerId = ""
+	state.ServerBackend = ""
+	state.ServerResponse = nil
 }
 
 func (m *LobbyMatch) MatchInit(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, params map[string]interface{}) (interface{}, int, string) {
-	isPrivate := false
-	matchName := ""
+	matchId, _ := ctx.Value(runtime.RUNTIME_CTX_MATCH_ID).(string)
 
-	if val, ok := params["isPrivate"]; ok {
-		isPrivate = val.(bool)
+	var p lobbyParams
+	if err := decodeParams(params, &p); err != nil {
+		// A nil state makes MatchCreate fail, which is all we can do here
+		logger.Error("refusing to create match %s: %v", matchId, err)
+		return nil, 0, ""
 	}
-	if val, ok := params["matchName"]; ok {
-		matchName = val.(string)
+
+	if p.Recovered != nil {
+		state := p.Recovered.restore(matchId)
+		// Points the game server's match ID at this match from now on
+		saveSnapshot(ctx, logger, nk, state)
+		label, err := getLabel(state)
+		if err != nil {
+			logger.Error("unable to build label for recovered match %s: %v", matchId, err)
+		}
+		return state, m.config.TickRate, label
 	}
 
 	state := &LobbyMatchState{
-		Players:             make(map[string]*PlayerState),
-		PlayerCount:         0,
-		RequiredPlayerCount: 2,
-		IsPrivate:           isPrivate,
-		GameState:           WaitingForPlayers,
-		EmptyTicks:          0,
-		CanJoin:             true,
-		MatchName:           matchName,
-		MatchId:             ctx.Value(runtime.RUNTIME_CTX_MATCH_ID).(string),
-	}
-
-	return state, tickRate, getLabel(state)
+		Players:         make(map[string]*PlayerState),
+		PlayerCount:     0,
+		IsPrivate:       p.IsPrivate,
+		GameState:       WaitingForPlayers,
+		EmptyTicks:      0,
+		CanJoin:         true,
+		MatchName:       p.MatchName,
+		MatchId:         matchId,
+		HostUserId:      p.HostUserId,
+		OriginalMatchId: matchId,
+		MutedUserIds:    make(map[string]bool),
+		ChatHistory:     make([]protocol.ChatMessage, 0),
+		Settings:        p.Settings,
+	}
+	mode, ok := currentGameModes().Modes[p.Settings.Mode]
+	if !ok {
+		// Only possible if the catalog was reloaded since the params were checked
+		logger.Error("refusing to create match %s: game mode %s no longer exists", matchId, p.Settings.Mode)
+		return nil, 0, ""
+	}
+	applyGameMode(state, mode)
+	m.analytics.emit(logger, eventLobbyCreated, state, state.HostUserId, 0, nil)
+
+	label, err := getLabel(state)
+	if err != nil {
+		logger.Error("unable to build label for new match %s: %v", matchId, err)
+	}
+
+	return state, m.config.TickRate, label
 }
 
 func (m *LobbyMatch) MatchJoinAttempt(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, dispatcher runtime.MatchDispatcher, tick int64, stateInterface interface{}, presence runtime.Presence, metadata map[string]string) (interface{}, bool, string) {
 	state, ok := stateInterface.(*LobbyMatchState)
 	if !ok {
-		panic("State is not a valid type")
+		return abortCorruptLobby(logger, dispatcher, stateInterface), false, "Lobby closed"
 	}
 
 	// Accept new players unless the required amount has been fulfilled
 	accept := true
 	reason := ""
+	rejection := ""
 	if len(state.Players) >= state.RequiredPlayerCount+state.AllowedObservers {
 		accept = false
 		reason = "Match full"
+		rejection = rejectFull
+	}
+	if state.ShuttingDown {
+		accept = false
+		reason = "Server shutting down"
+		rejection = rejectShuttingDown
+	}
+	// Only players coming back to the game may join a recovered lobby, since
+	// joining hands out the game server
+	observing, participant := state.Participants[presence.GetUserId()]
+	if state.Recovered && !participant {
+		accept = false
+		reason = "Not in this game"
+		rejection = rejectNotParticipant
+	}
+
+	// Turn away clients that don't speak a protocol version we support
+	version, err := protocol.NegotiateVersion(metadata)
+	if err != nil && accept {
+		logger.Info("rejecting join from %s: %v", presence.GetUserId(), err)
+		accept = false
+		reason = err.Error()
+		rejection = rejectProtocolVersion
+	}
+
+	encoding, err := protocol.NegotiateEncoding(metadata)
+	if err != nil && accept {
+		logger.Info("rejecting join from %s: %v", presence.GetUserId(), err)
+		accept = false
+		reason = err.Error()
+		rejection = rejectEncoding
+	}
+
+	// Clients may report their latency to each region up front
+	latencies := make(map[string]int)
+	if val, ok := metadata[latencyMetadataKey]; ok && accept {
+		parsed, err := parseLatencies(m.config.Regions, []byte(val))
+		if err != nil {
+			logger.Warn("rejecting join from %s with bad latency metadata: %v", presence.GetUserId(), err)
+			accept = false
+			reason = err.Error()
+			rejection = rejectLatencies
+		} else {
+			latencies = parsed
+		}
 	}
 
 	if accept {
@@ -207,11 +523,20 @@ func (m *LobbyMatch) MatchJoinAttempt(ctx context.Context, logger runtime.Logger
 			Presence:    nil,
 			IsReady:     false,
 			SlotNumber:  state.SlotNumber,
-			IsObserving: false,
+			IsObserving: observing,
 			DisplayName: "",
 			UserId:      "",
+			Latencies:   latencies,
+
+			ProtocolVersion: version,
+			Encoding:        encoding,
+			RateLimits:      make(map[int64]*tokenBucket),
 		}
 		state.SlotNumber++
+		// Takes the slot out of find_match's open lobbies straight away
+		updateLabel(logger, state, dispatcher)
+	} else {
+		m.metrics.joinRejected(state, rejection)
 	}
 
 	return state, accept, reason
@@ -220,39 +545,79 @@ func (m *LobbyMatch) MatchJoinAttempt(ctx context.Context, logger runtime.Logger
 func (m *LobbyMatch) MatchJoin(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, dispatcher runtime.MatchDispatcher, tick int64, stateInterface interface{}, presences []runtime.Presence) interface{} {
 	state, ok := stateInterface.(*LobbyMatchState)
 	if !ok {
-		panic("State is not a valid type")
+		return abortCorruptLobby(logger, dispatcher, stateInterface)
 	}
 
 	userIds := funk.Map(presences, func(p runtime.Presence) string {
 		return p.GetUserId()
 	}).([]string)
 
-	nkUsers, _ := nk.UsersGetId(ctx, userIds, []string{})
+	nkUsers, err := nk.UsersGetId(ctx, userIds, []string{})
+	if err != nil {
+		logger.Warn("unable to look up display names for match %s: %v", state.MatchId, err)
+	}
 	users := make(map[string]*api.User)
 	for _, u := range nkUsers {
 		users[u.Id] = u
 	}
 
+	// Work out roles before filling in presences, so that new players show up
+	// in joined events rather than moved ones
+	events := updateObserverFlags(state)
+	joined := make([]runtime.Presence, 0, len(presences))
+
 	// Populate the presence property for each player
 	for _, p := range presences {
-		player := state.Players[p.GetSessionId()]
+		player, ok := state.Players[p.GetSessionId()]
+		if !ok {
+			logger.Error("session %s joined match %s without reserving a slot", p.GetSessionId(), state.MatchId)
+			sendError(logger, state, dispatcher, []runtime.Presence{p}, protocol.ErrorCodeUnknownPlayer, "You don't have a slot in this lobby")
+			continue
+		}
 		player.Presence = p
 		player.UserId = p.GetUserId()
-		player.DisplayName = users[p.GetUserId()].DisplayName
-		state.PlayerCount = len(state.Players)
-	}
+		player.JoinedTick = tick
+		if user, ok := users[p.GetUserId()]; ok {
+			player.DisplayName = user.DisplayName
+		}
+		player.BlockedUserIds = loadBlockedUsers(ctx, logger, nk, p.GetUserId())
 
-	// If the match is full then update the state
-	if len(state.Players) >= state.RequiredPlayerCount {
-		state.GameState = WaitingForPlayersReady
+		m.analytics.emit(logger, eventPlayerJoined, state, player.UserId, 0, nil)
+		joined = append(joined, p)
+		events = append(events, newLobbyEvent(protocol.LobbyEventJoined, player))
 	}
 
-	updateObserverFlags(state)
-	broadcastLobbyUpdate(logger, state, dispatcher)
+	// Players who have only reserved a slot aren't counted until they join
+	state.PlayerCount = len(joinedPlayers(state))
+	updateWaitingState(state)
+
+	// The lobby needs a host if it was created without one or theirs left
+	// before anyone else arrived
+	hostChanged := ensureHost(state)
+
+	// Everyone else hears about the new players, who get the whole roster
+	if hostChanged {
+		broadcastLobbySnapshot(logger, state, dispatcher)
+	} else {
+		publishLobbyEvents(logger, state, dispatcher, events, joined)
+		sendLobbySnapshot(logger, state, dispatcher, joined)
+	}
+	for _, p := range joined {
+		sendChatHistory(logger, state, dispatcher, state.Players[p.GetSessionId()])
+	}
+	// Players coming back to a game in progress, such as after a restart,
+	// need to be told where it is again
+	if state.GameState == InProgress && len(joined) > 0 {
+		if dto, err := gameStartedDto(state, state.ServerResponse); err == nil {
+			send(logger, state, dispatcher, protocol.OP_GAME_START, dto, joined)
+		}
+	}
+	if state.Maintenance && state.GameState != InProgress && len(joined) > 0 {
+		send(logger, state, dispatcher, protocol.OP_MAINTENANCE, maintenanceBanner(m.config, state, tick), joined)
+	}
 
 	// Update the match label
-	label := getLabel(state)
-	dispatcher.MatchLabelUpdate(label)
+	updateLabel(logger, state, dispatcher)
 
 	return state
 }
@@ -260,16 +625,28 @@ func (m *LobbyMatch) MatchJoin(ctx context.Context, logger runtime.Logger, db *s
 func (m *LobbyMatch) MatchLeave(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, dispatcher runtime.MatchDispatcher, tick int64, stateInterface interface{}, presences []runtime.Presence) interface{} {
 	state, ok := stateInterface.(*LobbyMatchState)
 	if !ok {
-		panic("State is not a valid type")
+		return abortCorruptLobby(logger, dispatcher, stateInterface)
 	}
 
+	events := make([]lobbyEvent, 0)
 	for _, presence := range presences {
+		if player, ok := state.Players[presence.GetSessionId()]; ok && player.Presence != nil {
+			events = append(events, newLobbyEvent(protocol.LobbyEventLeft, player))
+			m.analytics.emit(logger, eventPlayerLeft, state, player.UserId, m.config.duration(tick-player.JoinedTick), nil)
+		}
 		delete(state.Players, presence.GetSessionId())
-		state.PlayerCount--
 	}
-
-	updateObserverFlags(state)
-	broadcastLobbyUpdate(logger, state, dispatcher)
+	// Recounted rather than decremented, since Nakama may report a leave for
+	// a session that never finished joining
+	state.PlayerCount = len(joinedPlayers(state))
+	updateWaitingState(state)
+
+	events = append(events, updateObserverFlags(state)...)
+	publishLobbyEvents(logger, state, dispatcher, events, nil)
+	if ensureHost(state) {
+		broadcastLobbySnapshot(logger, state, dispatcher)
+	}
+	updateLabel(logger, state, dispatcher)
 
 	return state
 }
@@ -277,68 +654,220 @@ func (m *LobbyMatch) MatchLeave(ctx context.Context, logger runtime.Logger, db *
 func (m *LobbyMatch) MatchLoop(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, dispatcher runtime.MatchDispatcher, tick int64, stateInterface interface{}, messages []runtime.MatchData) interface{} {
 	state, ok := stateInterface.(*LobbyMatchState)
 	if !ok {
-		panic("State is not a valid type")
+		return abortCorruptLobby(logger, dispatcher, stateInterface)
 	}
 
-	// If the match is empty, increment the empty ticks
-	if state.PlayerCount == 0 {
+	if state.GameState == Ended {
+		deleteSnapshot(ctx, logger, nk, state.OriginalMatchId)
+		m.reportEnd(logger, state, tick, endReasonGameEnded)
+		return nil
+	}
+
+	// If the match is empty, increment the empty ticks. Recovered lobbies
+	// give their players a while to reconnect first.
+	reconnecting := state.Recovered && tick < m.config.ticks(m.config.RecoveryTimeout)
+	if state.PlayerCount == 0 && !reconnecting {
 		state.EmptyTicks++
 		// If the match has been empty for too long, end it
-		if state.EmptyTicks > maxEmptyTicks {
+		if int64(state.EmptyTicks) > m.config.ticks(m.config.EmptyTimeout) {
+			m.queue.Remove(state.MatchId)
+			m.releaseServer(logger, state)
+			deleteSnapshot(ctx, logger, nk, state.OriginalMatchId)
+			m.metrics.emptyTerminated(state)
+			m.reportEnd(logger, state, tick, endReasonEmpty)
 			return nil
 		}
 	} else {
 		state.EmptyTicks = 0
 	}
 
-	shouldBroadcastLobbyUpdate := false
+	// The loop below shadows m
+	config := m.config
+	analytics := m.analytics
+	events := make([]lobbyEvent, 0)
 	for _, m := range messages {
+		if !allowMessage(logger, state, dispatcher, m, tick, config) {
+			continue
+		}
+
+		// A session that has only reserved a slot isn't in the lobby yet either
+		player, ok := state.Players[m.GetSessionId()]
+		if !ok || player.Presence == nil {
+			logger.Warn("ignoring opcode %d from session %s, which isn't in match %s", m.GetOpCode(), m.GetSessionId(), state.MatchId)
+			sendError(logger, state, dispatcher, []runtime.Presence{m}, protocol.ErrorCodeUnknownPlayer, "You aren't in this lobby")
+			continue
+		}
+
 		switch op := m.GetOpCode(); op {
-		case OP_READY:
-			sessionId := m.GetSessionId()
-			state.Players[sessionId].IsReady = true
-			dto := map[string]interface{}{
-				"sessionId": sessionId,
+		case protocol.OP_READY:
+			if err := decodeMessage(player, m.GetData(), &protocol.Ready{}); err != nil {
+				logger.Warn("ignoring malformed ready from %s: %v", m.GetUserId(), err)
+				sendError(logger, state, dispatcher, []runtime.Presence{m}, protocol.ErrorCodeBadMessage, err.Error())
+				break
+			}
+			if !player.IsReady {
+				player.IsReady = true
+				events = append(events, newLobbyEvent(protocol.LobbyEventReadied, player))
+				analytics.emit(logger, eventPlayerReadied, state, player.UserId, config.duration(tick-player.JoinedTick), nil)
+			}
+			dto := protocol.PlayerReady{
+				Version:   protocol.Version,
+				SessionId: m.GetSessionId(),
 			}
 
-			dispatcher.BroadcastMessage(OP_READY, toJsonBytes(dto), nil, nil, true)
-			shouldBroadcastLobbyUpdate = true
+			send(logger, state, dispatcher, protocol.OP_READY, dto, nil)
+			break
+		case protocol.OP_RESYNC_REQUEST:
+			if err := decodeMessage(player, m.GetData(), &protocol.ResyncRequest{}); err != nil {
+				logger.Warn("ignoring malformed resync request from %s: %v", m.GetUserId(), err)
+				sendError(logger, state, dispatcher, []runtime.Presence{m}, protocol.ErrorCodeBadMessage, err.Error())
+				break
+			}
+			sendLobbySnapshot(logger, state, dispatcher, []runtime.Presence{m})
+			break
+		case protocol.OP_REGION_LATENCY:
+			latencies, err := readLatencyReport(config.Regions, player, m.GetData())
+			if err != nil {
+				logger.Warn("ignoring malformed latency report from %s: %v", m.GetUserId(), err)
+				sendError(logger, state, dispatcher, []runtime.Presence{m}, protocol.ErrorCodeBadMessage, err.Error())
+				break
+			}
+			player.Latencies = latencies
+			break
+		case protocol.OP_CHAT_SEND:
+			handleChatSend(logger, state, dispatcher, player, m, config.chatFilter)
+			break
+		case protocol.OP_CHAT_MUTE:
+			handleChatMute(logger, state, dispatcher, player, m)
+			break
+		case protocol.OP_LOBBY_SETTINGS:
+			handleSettingsUpdate(logger, state, dispatcher, player, m)
 			break
 		}
 	}
 
-	if shouldBroadcastLobbyUpdate {
-		broadcastLobbyUpdate(logger, state, dispatcher)
-	}
+	publishLobbyEvents(logger, state, dispatcher, events, nil)
 
-	if state.GameState == WaitingForPlayersReady {
-		readyCount := 0
-		for _, p := range state.Players {
-			if !p.IsObserving && p.IsReady {
-				readyCount++
-			}
+	previousState := state.GameState
+	switch state.GameState {
+	case WaitingForPlayersReady:
+		// Nothing launches once the server is shutting down
+		if countReadyPlayers(state) >= state.RequiredPlayerCount && !state.ShuttingDown {
+			state.ReadyTick = tick
+			m.analytics.emit(logger, eventLaunchRequested, state, "", m.config.duration(tick), nil)
+			m.launch(logger, state, dispatcher, tick)
 		}
+	case WaitingForServer:
+		// Give up our place in line if someone left while we were waiting
+		if countReadyPlayers(state) < state.RequiredPlayerCount {
+			m.analytics.emit(logger, eventLaunchFailed, state, "", m.config.duration(tick-state.ReadyTick), map[string]string{"reason": launchFailedUnready})
+			m.queue.Remove(state.MatchId)
+			state.GameState = WaitingForPlayersReady
+			state.QueuePosition = 0
+			updateWaitingState(state)
+			broadcastQueuePosition(logger, state, dispatcher)
+		} else {
+			m.launch(logger, state, dispatcher, tick)
+		}
+	}
 
-		if readyCount >= state.RequiredPlayerCount {
-			responseBytes, err := spinUpServer(state.MatchId)
-			if err != nil {
-				panic(err)
-			}
+	// Snapshot as soon as a game starts, since those are the lobbies worth
+	// recovering, and every so often after that
+	launched := state.GameState == InProgress && previousState != InProgress
+	if launched || tick%m.config.ticks(m.config.SnapshotInterval) == 0 {
+		saveSnapshot(ctx, logger, nk, state)
+	}
+	if !state.EndReported {
+		m.metrics.observe(state)
+	}
 
-			state.GameState = InProgress
-			state.CanJoin = false
+	return state
+}
 
-			broadcastGameStarted(logger, state, dispatcher, responseBytes)
+// reportEnd takes the lobby out of the gauges and emits lobby_ended, unless
+// that has been done already.
+func (m *LobbyMatch) reportEnd(logger runtime.Logger, state *LobbyMatchState, tick int64, reason string) {
+	if state.EndReported {
+		return
+	}
+	state.EndReported = true
+	m.metrics.forget(state.MatchId)
+	m.analytics.emit(logger, eventLobbyEnded, state, "", m.config.duration(tick), map[string]string{"reason": reason})
+}
+
+// MatchTerminate is called when the server starts shutting down, and the lobby
+// keeps running for graceSeconds after. Games in progress carry on, with their
+// game server handed over to the lobby recovered from the snapshot saved here
+// after the restart. Lobbies that haven't launched can't outlive the restart,
+// so they stop launching, give up their place in the queue and unready
+// everyone, leaving players free to join another lobby.
+func (m *LobbyMatch) MatchTerminate(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, dispatcher runtime.MatchDispatcher, tick int64, stateInterface interface{}, graceSeconds int) interface{} {
+	state, ok := stateInterface.(*LobbyMatchState)
+	if !ok {
+		return stateInterface
+	}
+
+	resumes := state.GameState == InProgress
+	logger.Info("match %s shutting down in %ds, resumes after restart: %v", state.MatchId, graceSeconds, resumes)
+	state.ShuttingDown = true
+
+	if resumes {
+		saveSnapshot(ctx, logger, nk, state)
+	} else {
+		m.queue.Remove(state.MatchId)
+		m.releaseServer(logger, state)
+		for _, p := range state.Players {
+			p.IsReady = false
+		}
+		if state.GameState == WaitingForServer {
+			state.GameState = WaitingForPlayersReady
+			state.QueuePosition = 0
+			updateWaitingState(state)
 		}
+		state.CanJoin = false
+		updateLabel(logger, state, dispatcher)
+		broadcastLobbySnapshot(logger, state, dispatcher)
+		// The lobby lives out the grace period, but this is as far as it gets
+		m.reportEnd(logger, state, tick, endReasonShutdown)
 	}
 
-	return state
-}
+	dto := protocol.ServerShutdown{
+		Version:      protocol.Version,
+		GraceSeconds: graceSeconds,
+		Resumes:      resumes,
+	}
+	send(logger, state, dispatcher, protocol.OP_SERVER_SHUTDOWN, dto, nil)
 
-func (m *LobbyMatch) MatchTerminate(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, dispatcher runtime.MatchDispatcher, tick int64, state interface{}, graceSeconds int) interface{} {
 	return state
 }
 
-func (m *LobbyMatch) MatchSignal(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, dispatcher runtime.MatchDispatcher, tick int64, state interface{}, data string) (interface{}, string) {
+func (m *LobbyMatch) MatchSignal(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, dispatcher runtime.MatchDispatcher, tick int64, stateInterface interface{}, data string) (interface{}, string) {
+	state, ok := stateInterface.(*LobbyMatchState)
+	if !ok {
+		return abortCorruptLobby(logger, dispatcher, stateInterface), ""
+	}
+
+	if data == signalGameEnded {
+		// The lobby has nothing left to do, so end it on the next tick
+		m.releaseServer(logger, state)
+		state.GameState = Ended
+	}
+
+	if notice, ok, err := parseMaintenanceSignal(data); err != nil {
+		logger.Warn("match %s ignoring bad maintenance signal %q: %v", state.MatchId, data, err)
+	} else if ok {
+		state.Maintenance = notice.Active
+		state.MaintenanceMessage = notice.Message
+		state.MaintenanceTick = 0
+		if notice.Active {
+			state.MaintenanceTick = tick + m.config.ticks(time.Duration(notice.StartsInSeconds)*time.Second)
+		}
+		// Games in progress outlive the maintenance, so their players don't
+		// need to hear about it
+		if state.GameState != InProgress {
+			send(logger, state, dispatcher, protocol.OP_MAINTENANCE, maintenanceBanner(m.config, state, tick), nil)
+		}
+	}
+
 	return state, data
 }
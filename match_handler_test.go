@@ -0,0 +1,429 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+
+	"imps/mpserver/fakeservermanager"
+	"imps/mpserver/nakamatest"
+	"imps/mpserver/protocol"
+)
+
+var deltaClient = map[string]string{protocol.VersionMetadataKey: "2"}
+
+func TestLobbyJoinAttempt(t *testing.T) {
+	tests := []struct {
+		name       string
+		before     int
+		metadata   map[string]string
+		wantAccept bool
+		wantReason string
+	}{
+		{name: "first player", wantAccept: true},
+		{name: "legacy client", metadata: map[string]string{}, wantAccept: true},
+		{name: "protobuf client", metadata: map[string]string{protocol.EncodingMetadataKey: protocol.EncodingProtobuf}, wantAccept: true},
+		{name: "lobby full", before: 2, wantReason: "Match full"},
+		{name: "future protocol version", metadata: map[string]string{protocol.VersionMetadataKey: "99"}, wantReason: "unsupported protocol version 99"},
+		{name: "unknown encoding", metadata: map[string]string{protocol.EncodingMetadataKey: "xml"}, wantReason: `unsupported encoding "xml"`},
+		{name: "latency to unknown region", metadata: map[string]string{latencyMetadataKey: `{"latencies":{"moon":5}}`}, wantReason: "latencies.moon: must be one of"},
+		{name: "latencies", metadata: map[string]string{latencyMetadataKey: `{"latencies":{"eu-west":40}}`}, wantAccept: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newLobbyHarness(t, nil)
+			h.init("host", protocol.LobbySettings{})
+			for i := 0; i < tt.before; i++ {
+				h.join(h.nk.AddUser(string(rune('a'+i)), "Player"), deltaClient)
+			}
+
+			accepted, reason := h.join(h.nk.AddUser("joiner", "Joiner"), tt.metadata)
+			if accepted != tt.wantAccept {
+				t.Fatalf("accepted = %v (%q), want %v", accepted, reason, tt.wantAccept)
+			}
+			if !strings.Contains(reason, tt.wantReason) {
+				t.Errorf("reason = %q, want it to contain %q", reason, tt.wantReason)
+			}
+			if got := len(h.lobby().Players); got != tt.before+map[bool]int{true: 1}[accepted] {
+				t.Errorf("lobby has %d players", got)
+			}
+		})
+	}
+}
+
+func TestLobbyJoin(t *testing.T) {
+	h := newLobbyHarness(t, nil)
+	h.init("host", protocol.LobbySettings{})
+	host := h.nk.AddUser("host", "Host")
+	guest := h.nk.AddUser("guest", "Guest")
+
+	h.join(host, deltaClient)
+	if state := h.lobby().GameState; state != WaitingForPlayers {
+		t.Errorf("game state after one join = %v", state)
+	}
+
+	h.join(guest, deltaClient)
+	lobby := h.lobby()
+	if lobby.GameState != WaitingForPlayersReady {
+		t.Errorf("game state after two joins = %v", lobby.GameState)
+	}
+	if label := h.label(); label.PlayerCount != 2 || label.Mode != "deathmatch" || label.CanJoin != "true" {
+		t.Errorf("label = %+v", label)
+	}
+
+	snapshots := received[protocol.LobbyUpdate](h, guest, protocol.OP_LOBBY_UPDATE)
+	if len(snapshots) != 1 || len(snapshots[0].Players) != 2 || snapshots[0].HostUserId != "host" {
+		t.Fatalf("guest snapshots = %+v", snapshots)
+	}
+	if name := snapshots[0].Players[1].DisplayName; name != "Guest" {
+		t.Errorf("guest display name = %q", name)
+	}
+
+	deltas := received[protocol.LobbyDelta](h, host, protocol.OP_LOBBY_DELTA)
+	if len(deltas) != 1 || deltas[0].Event != protocol.LobbyEventJoined || deltas[0].Player.UserId != "guest" {
+		t.Errorf("host deltas = %+v", deltas)
+	}
+	if len(received[protocol.ChatHistory](h, guest, protocol.OP_CHAT_HISTORY)) != 1 {
+		t.Errorf("guest didn't get the chat history")
+	}
+}
+
+// Clients that don't say which version they speak are treated as version 1,
+// and get messages the way version 1 sent them.
+func TestLobbyMessagesMatchClientVersion(t *testing.T) {
+	h := newLobbyHarness(t, nil)
+	h.init("host", protocol.LobbySettings{})
+	host := h.nk.AddUser("host", "Host")
+	guest := h.nk.AddUser("guest", "Guest")
+	h.join(host, nil)
+	h.join(guest, deltaClient)
+	h.loop(message(host, protocol.OP_READY, protocol.Ready{}), message(guest, protocol.OP_READY, protocol.Ready{}))
+	if state := h.lobby().GameState; state != InProgress {
+		t.Fatalf("game state = %v", state)
+	}
+
+	for _, tt := range []struct {
+		presence *nakamatest.Presence
+		version  int
+	}{{host, 1}, {guest, 2}} {
+		readies := received[protocol.PlayerReady](h, tt.presence, protocol.OP_READY)
+		if len(readies) == 0 {
+			t.Errorf("%s wasn't told who readied", tt.presence.UserId)
+		}
+		for _, ready := range readies {
+			if ready.Version != tt.version {
+				t.Errorf("%s was sent PlayerReady version %d, want %d", tt.presence.UserId, ready.Version, tt.version)
+			}
+		}
+	}
+
+	legacy := received[map[string]interface{}](h, host, protocol.OP_GAME_START)
+	if len(legacy) != 1 || legacy[0]["matchId"] != "lobby.node" || legacy[0]["region"] != h.lobby().Region || legacy[0]["server"] != nil {
+		t.Errorf("version 1 game starts = %+v", legacy)
+	}
+	starts := received[protocol.GameStart](h, guest, protocol.OP_GAME_START)
+	if len(starts) != 1 || starts[0].Version != 2 || starts[0].Region != h.lobby().Region || !strings.Contains(string(starts[0].Server), `"matchId":"lobby.node"`) {
+		t.Errorf("version 2 game starts = %+v", starts)
+	}
+}
+
+func TestLobbyLoop(t *testing.T) {
+	tests := []struct {
+		name string
+		// Sets up the fake server manager
+		serverManager func(s *fakeservermanager.Server)
+		// Who each user blocks, by user ID
+		blocked map[string][]string
+		// Runs once host and guest have joined
+		run   func(h *lobbyHarness, host, guest *nakamatest.Presence)
+		check func(t *testing.T, h *lobbyHarness, host, guest *nakamatest.Presence)
+	}{
+		{
+			name: "everyone ready launches",
+			run: func(h *lobbyHarness, host, guest *nakamatest.Presence) {
+				h.loop(message(host, protocol.OP_READY, protocol.Ready{}), message(guest, protocol.OP_READY, protocol.Ready{}))
+			},
+			check: func(t *testing.T, h *lobbyHarness, host, guest *nakamatest.Presence) {
+				if state := h.lobby().GameState; state != InProgress {
+					t.Fatalf("game state = %v", state)
+				}
+				starts := received[protocol.GameStart](h, guest, protocol.OP_GAME_START)
+				if len(starts) != 1 || !strings.Contains(string(starts[0].Server), `"matchId":"lobby.node"`) {
+					t.Errorf("game starts = %+v", starts)
+				}
+				if label := h.label(); label.CanJoin != "false" {
+					t.Errorf("label still joinable: %+v", label)
+				}
+			},
+		},
+		{
+			name:          "no capacity waits in the queue",
+			serverManager: func(s *fakeservermanager.Server) { s.SetCapacity(0) },
+			run: func(h *lobbyHarness, host, guest *nakamatest.Presence) {
+				h.loop(message(host, protocol.OP_READY, protocol.Ready{}), message(guest, protocol.OP_READY, protocol.Ready{}))
+			},
+			check: func(t *testing.T, h *lobbyHarness, host, guest *nakamatest.Presence) {
+				if state := h.lobby().GameState; state != WaitingForServer {
+					t.Fatalf("game state = %v", state)
+				}
+				positions := received[protocol.QueuePosition](h, host, protocol.OP_QUEUE_POSITION)
+				if len(positions) != 1 || positions[0].Position != 1 {
+					t.Errorf("queue positions = %+v", positions)
+				}
+			},
+		},
+		{
+			name:          "allocation failure unreadies everyone",
+			serverManager: func(s *fakeservermanager.Server) { s.SetFailureRate(1) },
+			run: func(h *lobbyHarness, host, guest *nakamatest.Presence) {
+				h.loop(message(host, protocol.OP_READY, protocol.Ready{}), message(guest, protocol.OP_READY, protocol.Ready{}))
+			},
+			check: func(t *testing.T, h *lobbyHarness, host, guest *nakamatest.Presence) {
+				if state := h.lobby().GameState; state != WaitingForPlayersReady {
+					t.Fatalf("game state = %v", state)
+				}
+				if countReadyPlayers(h.lobby()) != 0 {
+					t.Errorf("players still ready after a failed launch")
+				}
+				errs := received[protocol.ErrorMessage](h, guest, protocol.OP_ERROR)
+				if len(errs) != 1 || errs[0].Code != protocol.ErrorCodeLaunchFailed {
+					t.Errorf("errors = %+v", errs)
+				}
+			},
+		},
+		{
+			name:    "chat is filtered and skips blockers",
+			blocked: map[string][]string{"guest": {"host"}},
+			run: func(h *lobbyHarness, host, guest *nakamatest.Presence) {
+				observer := h.nk.AddUser("observer", "Observer")
+				h.lobby().AllowedObservers = 1
+				h.join(observer, deltaClient)
+				h.loop(message(host, protocol.OP_CHAT_SEND, protocol.ChatSend{Text: "well DARN it"}))
+			},
+			check: func(t *testing.T, h *lobbyHarness, host, guest *nakamatest.Presence) {
+				if got := received[protocol.ChatMessage](h, guest, protocol.OP_CHAT_MESSAGE); len(got) != 0 {
+					t.Errorf("guest blocked the host but got %+v", got)
+				}
+				observer := &nakamatest.Presence{SessionId: "session-observer"}
+				got := received[protocol.ChatMessage](h, observer, protocol.OP_CHAT_MESSAGE)
+				if len(got) != 1 || got[0].Text != "well **** it" || got[0].DisplayName != "Host" {
+					t.Errorf("observer chat = %+v", got)
+				}
+			},
+		},
+		{
+			name: "muted players can't chat",
+			run: func(h *lobbyHarness, host, guest *nakamatest.Presence) {
+				h.loop(message(host, protocol.OP_CHAT_MUTE, protocol.ChatMute{UserId: "guest", Muted: true}))
+				h.loop(message(guest, protocol.OP_CHAT_SEND, protocol.ChatSend{Text: "hello"}))
+			},
+			check: func(t *testing.T, h *lobbyHarness, host, guest *nakamatest.Presence) {
+				errs := received[protocol.ErrorMessage](h, guest, protocol.OP_ERROR)
+				if len(errs) != 1 || errs[0].Code != protocol.ErrorCodeMuted {
+					t.Errorf("errors = %+v", errs)
+				}
+				if len(h.lobby().ChatHistory) != 0 {
+					t.Errorf("muted chat made it into the history")
+				}
+			},
+		},
+		{
+			name: "only the host changes settings",
+			run: func(h *lobbyHarness, host, guest *nakamatest.Presence) {
+				h.loop(message(guest, protocol.OP_LOBBY_SETTINGS, protocol.LobbySettings{Map: "canyon"}))
+				h.loop(message(host, protocol.OP_LOBBY_SETTINGS, protocol.LobbySettings{Map: "foundry"}))
+			},
+			check: func(t *testing.T, h *lobbyHarness, host, guest *nakamatest.Presence) {
+				errs := received[protocol.ErrorMessage](h, guest, protocol.OP_ERROR)
+				if len(errs) != 1 || errs[0].Code != protocol.ErrorCodeNotHost {
+					t.Errorf("errors = %+v", errs)
+				}
+				if m := h.lobby().Settings.Map; m != "foundry" {
+					t.Errorf("map = %q", m)
+				}
+				if label := h.label(); label.Map != "foundry" {
+					t.Errorf("label = %+v", label)
+				}
+			},
+		},
+		{
+			name: "flooding gets a session kicked",
+			run: func(h *lobbyHarness, host, guest *nakamatest.Presence) {
+				flood := make([]runtime.MatchData, 0)
+				for i := 0; i < rateLimitKickAfter+3; i++ {
+					flood = append(flood, message(guest, protocol.OP_RESYNC_REQUEST, protocol.ResyncRequest{}))
+				}
+				h.loop(flood...)
+			},
+			check: func(t *testing.T, h *lobbyHarness, host, guest *nakamatest.Presence) {
+				if len(h.dispatcher.Kicked) != 1 || h.dispatcher.Kicked[0].GetSessionId() != guest.SessionId {
+					t.Errorf("kicked = %+v", h.dispatcher.Kicked)
+				}
+				errs := received[protocol.ErrorMessage](h, guest, protocol.OP_ERROR)
+				if len(errs) != 1 || errs[0].Code != protocol.ErrorCodeRateLimited {
+					t.Errorf("errors = %+v", errs)
+				}
+			},
+		},
+		{
+			name: "flooding with a new opcode each time gets a session kicked",
+			run: func(h *lobbyHarness, host, guest *nakamatest.Presence) {
+				flood := make([]runtime.MatchData, 0)
+				for i := 0; i < rateLimitKickAfter+int(defaultRateLimit.Burst); i++ {
+					flood = append(flood, &nakamatest.MatchData{Presence: guest, OpCode: int64(100 + i), Data: []byte("{}")})
+				}
+				h.loop(flood...)
+			},
+			check: func(t *testing.T, h *lobbyHarness, host, guest *nakamatest.Presence) {
+				if len(h.dispatcher.Kicked) != 1 || h.dispatcher.Kicked[0].GetSessionId() != guest.SessionId {
+					t.Errorf("kicked = %+v", h.dispatcher.Kicked)
+				}
+				if buckets := h.lobby().Players[guest.SessionId].RateLimits; len(buckets) != 1 {
+					t.Errorf("guest has %d rate limit buckets, want the shared one", len(buckets))
+				}
+				errs := received[protocol.ErrorMessage](h, guest, protocol.OP_ERROR)
+				if len(errs) != int(defaultRateLimit.Burst)+1 || errs[0].Code != protocol.ErrorCodeBadMessage {
+					t.Errorf("errors = %+v", errs)
+				}
+			},
+		},
+		{
+			name: "strangers are turned away",
+			run: func(h *lobbyHarness, host, guest *nakamatest.Presence) {
+				h.loop(message(&nakamatest.Presence{UserId: "stranger", SessionId: "stranger"}, protocol.OP_READY, protocol.Ready{}))
+			},
+			check: func(t *testing.T, h *lobbyHarness, host, guest *nakamatest.Presence) {
+				stranger := &nakamatest.Presence{SessionId: "stranger"}
+				errs := received[protocol.ErrorMessage](h, stranger, protocol.OP_ERROR)
+				if len(errs) != 1 || errs[0].Code != protocol.ErrorCodeUnknownPlayer {
+					t.Errorf("errors = %+v", errs)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newLobbyHarness(t, map[string]string{envChatFilter: "darn"})
+			if tt.serverManager != nil {
+				tt.serverManager(h.serverManager)
+			}
+			for user, blocked := range tt.blocked {
+				h.nk.Blocked[user] = blocked
+			}
+			h.init("host", protocol.LobbySettings{})
+			host := h.nk.AddUser("host", "Host")
+			guest := h.nk.AddUser("guest", "Guest")
+			h.join(host, deltaClient)
+			h.join(guest, deltaClient)
+			h.dispatcher.Reset()
+
+			tt.run(h, host, guest)
+			tt.check(t, h, host, guest)
+		})
+	}
+}
+
+func TestLobbyConfiguredRateLimit(t *testing.T) {
+	h := newLobbyHarness(t, map[string]string{envRateLimits: "9=1/0.1"})
+	h.init("host", protocol.LobbySettings{})
+	host := h.nk.AddUser("host", "Host")
+	guest := h.nk.AddUser("guest", "Guest")
+	h.join(host, deltaClient)
+	h.join(guest, deltaClient)
+
+	h.loop(message(guest, protocol.OP_CHAT_SEND, protocol.ChatSend{Text: "one"}), message(guest, protocol.OP_CHAT_SEND, protocol.ChatSend{Text: "two"}))
+	if chat := received[protocol.ChatMessage](h, host, protocol.OP_CHAT_MESSAGE); len(chat) != 1 || chat[0].Text != "one" {
+		t.Errorf("host was sent chat %+v, want only the first message", chat)
+	}
+	if violations := h.lobby().Players[guest.SessionId].Violations; violations != 1 {
+		t.Errorf("guest has %d violations, want 1", violations)
+	}
+}
+
+func TestLobbyLeave(t *testing.T) {
+	h := newLobbyHarness(t, nil)
+	h.init("host", protocol.LobbySettings{})
+	host := h.nk.AddUser("host", "Host")
+	guest := h.nk.AddUser("guest", "Guest")
+	h.join(host, deltaClient)
+	h.join(guest, deltaClient)
+	h.dispatcher.Reset()
+
+	h.leave(host)
+	if hostId := h.lobby().HostUserId; hostId != "guest" {
+		t.Errorf("host after the host left = %q", hostId)
+	}
+	snapshots := received[protocol.LobbyUpdate](h, guest, protocol.OP_LOBBY_UPDATE)
+	if len(snapshots) != 1 || snapshots[0].HostUserId != "guest" {
+		t.Errorf("guest snapshots = %+v", snapshots)
+	}
+
+	h.leave(guest)
+	for i := int64(0); i <= h.config.ticks(h.config.EmptyTimeout); i++ {
+		h.loop()
+	}
+	if h.state != nil {
+		t.Errorf("empty lobby is still running")
+	}
+}
+
+func TestLobbyTerminate(t *testing.T) {
+	tests := []struct {
+		name        string
+		launch      bool
+		wantResumes bool
+	}{
+		{name: "waiting lobby closes"},
+		{name: "game in progress resumes", launch: true, wantResumes: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newLobbyHarness(t, nil)
+			h.init("host", protocol.LobbySettings{})
+			host := h.nk.AddUser("host", "Host")
+			guest := h.nk.AddUser("guest", "Guest")
+			h.join(host, deltaClient)
+			h.join(guest, deltaClient)
+			h.loop(message(host, protocol.OP_READY, protocol.Ready{}))
+			if tt.launch {
+				h.loop(message(guest, protocol.OP_READY, protocol.Ready{}))
+			}
+			serverId := h.lobby().ServerId
+			h.dispatcher.Reset()
+
+			h.terminate(30)
+			notices := received[protocol.ServerShutdown](h, guest, protocol.OP_SERVER_SHUTDOWN)
+			if len(notices) != 1 || notices[0].GraceSeconds != 30 || notices[0].Resumes != tt.wantResumes {
+				t.Errorf("shutdown notices = %+v", notices)
+			}
+			if accepted, reason := h.join(h.nk.AddUser("late", "Late"), deltaClient); accepted || reason != "Server shutting down" {
+				t.Errorf("join during shutdown: accepted %v, %q", accepted, reason)
+			}
+
+			lobby := h.lobby()
+			if tt.wantResumes {
+				snapshot, err := readSnapshot(h.ctx, h.nk, "lobby.node")
+				if err != nil || snapshot == nil || snapshot.ServerId != serverId {
+					t.Errorf("snapshot = %+v, %v", snapshot, err)
+				}
+				if lobby.ServerId != serverId || len(h.serverManager.Released()) != 0 {
+					t.Errorf("game server %s released, lobby has %q", serverId, lobby.ServerId)
+				}
+				return
+			}
+
+			if countReadyPlayers(lobby) != 0 || h.label().CanJoin != "false" {
+				t.Errorf("lobby still ready or joinable: %+v", lobby)
+			}
+			// Readying up again doesn't launch a game the server can't keep
+			h.loop(message(host, protocol.OP_READY, protocol.Ready{}), message(guest, protocol.OP_READY, protocol.Ready{}))
+			if state := h.lobby().GameState; state != WaitingForPlayersReady || len(h.serverManager.Servers()) != 0 {
+				t.Errorf("lobby launched during shutdown, state %v", state)
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Metrics are reported through Nakama, which serves them to Prometheus with
+// its own. Everything is labeled by mode and region, and lobbies that haven't
+// picked a region yet report it as regionNone.
+const (
+	metricLobbies           = "lobby_lobbies"
+	metricPlayers           = "lobby_players"
+	metricObservers         = "lobby_observers"
+	metricJoinRejections    = "lobby_join_rejections"
+	metricEmptyTerminations = "lobby_empty_terminations"
+	metricReadyToLaunch     = "lobby_ready_to_launch"
+	metricAllocation        = "lobby_allocation"
+	metricAllocationErrors  = "lobby_allocation_errors"
+
+	regionNone = "none"
+)
+
+// Why a join attempt was turned away, as the reason label of
+// lobby_join_rejections. The reason sent to the client is free text.
+const (
+	rejectFull            = "full"
+	rejectShuttingDown    = "shutting_down"
+	rejectProtocolVersion = "protocol_version"
+	rejectEncoding        = "encoding"
+	rejectLatencies       = "latencies"
+	rejectNotParticipant  = "not_participant"
+)
+
+// Why a game server couldn't be had, as the error label of
+// lobby_allocation_errors
+const (
+	allocationErrorExhausted   = "exhausted"
+	allocationErrorFailed      = "failed"
+	allocationErrorBadResponse = "bad_response"
+)
+
+var gameStateNames = map[GameState]string{
+	WaitingForPlayers:      "waiting_for_players",
+	WaitingForPlayersReady: "waiting_for_players_ready",
+	Launching:              "launching",
+	InProgress:             "in_progress",
+	WaitingForServer:       "waiting_for_server",
+	Ended:                  "ended",
+}
+
+// metricsSink is the part of runtime.NakamaModule metrics go through.
+type metricsSink interface {
+	MetricsCounterAdd(name string, tags map[string]string, delta int64)
+	MetricsGaugeSet(name string, tags map[string]string, value float64)
+	MetricsTimerRecord(name string, tags map[string]string, value time.Duration)
+}
+
+// lobbySample is what a lobby adds to the gauges.
+type lobbySample struct {
+	state     string
+	mode      string
+	region    string
+	players   int
+	observers int
+}
+
+type lobbyGauge struct {
+	name   string
+	state  string
+	mode   string
+	region string
+}
+
+// lobbyMetrics is shared by every lobby on the node. Gauges are totals over
+// all of them, so it keeps each lobby's last sample and moves the totals by
+// the difference when a lobby changes.
+type lobbyMetrics struct {
+	sink metricsSink
+
+	mu      sync.Mutex
+	samples map[string]lobbySample
+	totals  map[lobbyGauge]float64
+}
+
+func newLobbyMetrics(sink metricsSink) *lobbyMetrics {
+	return &lobbyMetrics{
+		sink:    sink,
+		samples: make(map[string]lobbySample),
+		totals:  make(map[lobbyGauge]float64),
+	}
+}
+
+func lobbyTags(state *LobbyMatchState) map[string]string {
+	region := state.Region
+	if region == "" {
+		region = regionNone
+	}
+	return map[string]string{"mode": state.Settings.Mode, "region": region}
+}
+
+func sampleLobby(state *LobbyMatchState) lobbySample {
+	tags := lobbyTags(state)
+	sample := lobbySample{state: gameStateNames[state.GameState], mode: tags["mode"], region: tags["region"]}
+	for _, p := range joinedPlayers(state) {
+		if p.IsObserving {
+			sample.observers++
+		} else {
+			sample.players++
+		}
+	}
+	return sample
+}
+
+// observe brings the gauges up to date with the lobby. Lobbies call it once a
+// tick, which is as fresh as Prometheus needs.
+func (m *lobbyMetrics) observe(state *LobbyMatchState) {
+	sample := sampleLobby(state)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	previous, ok := m.samples[state.MatchId]
+	if ok && previous == sample {
+		return
+	}
+	if ok {
+		m.add(previous, -1)
+	}
+	m.samples[state.MatchId] = sample
+	m.add(sample, 1)
+}
+
+// forget takes an ended lobby out of the gauges.
+func (m *lobbyMetrics) forget(matchId string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if previous, ok := m.samples[matchId]; ok {
+		m.add(previous, -1)
+		delete(m.samples, matchId)
+	}
+}
+
+// add moves the totals by sign times the sample and reports them. The caller
+// holds mu.
+func (m *lobbyMetrics) add(sample lobbySample, sign float64) {
+	gauges := map[lobbyGauge]float64{
+		{metricLobbies, sample.state, sample.mode, sample.region}: 1,
+		{metricPlayers, "", sample.mode, sample.region}:           float64(sample.players),
+		{metricObservers, "", sample.mode, sample.region}:         float64(sample.observers),
+	}
+	for gauge, value := range gauges {
+		m.totals[gauge] += sign * value
+		tags := map[string]string{"mode": gauge.mode, "region": gauge.region}
+		if gauge.state != "" {
+			tags["state"] = gauge.state
+		}
+		m.sink.MetricsGaugeSet(gauge.name, tags, m.totals[gauge])
+	}
+}
+
+func (m *lobbyMetrics) joinRejected(state *LobbyMatchState, reason string) {
+	tags := lobbyTags(state)
+	tags["reason"] = reason
+	m.sink.MetricsCounterAdd(metricJoinRejections, tags, 1)
+}
+
+func (m *lobbyMetrics) emptyTerminated(state *LobbyMatchState) {
+	m.sink.MetricsCounterAdd(metricEmptyTerminations, lobbyTags(state), 1)
+}
+
+// launched records how long the lobby took to get a game server once
+// everyone was ready, queueing included.
+func (m *lobbyMetrics) launched(state *LobbyMatchState, waited time.Duration) {
+	m.sink.MetricsTimerRecord(metricReadyToLaunch, lobbyTags(state), waited)
+}
+
+// allocated records how long the allocator took to answer a lobby heading to
+// region, however it answered.
+func (m *lobbyMetrics) allocated(state *LobbyMatchState, region string, took time.Duration) {
+	m.sink.MetricsTimerRecord(metricAllocation, allocationTags(state, region), took)
+}
+
+func (m *lobbyMetrics) allocationFailed(state *LobbyMatchState, region string, kind string) {
+	tags := allocationTags(state, region)
+	tags["error"] = kind
+	m.sink.MetricsCounterAdd(metricAllocationErrors, tags, 1)
+}
+
+// allocationTags label allocations by the region being asked for, since the
+// lobby's own isn't set until it has a server.
+func allocationTags(state *LobbyMatchState, region string) map[string]string {
+	tags := lobbyTags(state)
+	if region != "" {
+		tags["region"] = region
+	}
+	return tags
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"imps/mpserver/nakamatest"
+	"imps/mpserver/protocol"
+)
+
+func gauge(h *lobbyHarness, name string, tags map[string]string) float64 {
+	return h.nk.Gauges[nakamatest.MetricKey(name, tags)]
+}
+
+func TestLobbyMetrics(t *testing.T) {
+	waiting := map[string]string{"mode": "deathmatch", "region": regionNone}
+	withState := func(tags map[string]string, state string) map[string]string {
+		tagged := map[string]string{"state": state}
+		for k, v := range tags {
+			tagged[k] = v
+		}
+		return tagged
+	}
+
+	h := newLobbyHarness(t, nil)
+	h.init("host", protocol.LobbySettings{})
+	host := h.nk.AddUser("host", "Host")
+	guest := h.nk.AddUser("guest", "Guest")
+	h.join(host, deltaClient)
+	h.join(guest, deltaClient)
+	h.loop()
+
+	if n := gauge(h, metricLobbies, withState(waiting, "waiting_for_players_ready")); n != 1 {
+		t.Errorf("waiting lobbies = %v", n)
+	}
+	if n := gauge(h, metricPlayers, waiting); n != 2 {
+		t.Errorf("waiting players = %v", n)
+	}
+
+	// Everyone readies, and the lobby moves over to its region
+	h.serverManager.SetCapacity(0)
+	h.loop(message(host, protocol.OP_READY, protocol.Ready{}), message(guest, protocol.OP_READY, protocol.Ready{}))
+	h.serverManager.SetCapacity(10)
+	for i := int64(0); i <= h.config.ticks(h.config.AllocationRetry) && h.lobby().GameState != InProgress; i++ {
+		h.loop()
+	}
+	lobby := h.lobby()
+	if lobby.GameState != InProgress {
+		t.Fatalf("lobby didn't launch, state %v", lobby.GameState)
+	}
+	launched := map[string]string{"mode": "deathmatch", "region": lobby.Region}
+	if n := gauge(h, metricLobbies, withState(waiting, "waiting_for_players_ready")); n != 0 {
+		t.Errorf("waiting lobbies after launch = %v", n)
+	}
+	if n := gauge(h, metricLobbies, withState(launched, "in_progress")); n != 1 {
+		t.Errorf("lobbies in progress = %v", n)
+	}
+	if n := gauge(h, metricPlayers, launched); n != 2 {
+		t.Errorf("players in progress = %v", n)
+	}
+	if n := h.nk.Counters[nakamatest.MetricKey(metricAllocationErrors, map[string]string{"mode": "deathmatch", "region": lobby.Region, "error": allocationErrorExhausted})]; n != 1 {
+		t.Errorf("exhausted allocations = %v, counters %v", n, h.nk.Counters)
+	}
+	if timings := h.nk.Timers[nakamatest.MetricKey(metricAllocation, launched)]; len(timings) != 2 {
+		t.Errorf("allocation timings = %v", timings)
+	}
+	timings := h.nk.Timers[nakamatest.MetricKey(metricReadyToLaunch, launched)]
+	if len(timings) != 1 || timings[0] < h.config.AllocationRetry {
+		t.Errorf("ready to launch timings = %v, want one covering the retry", timings)
+	}
+
+	// A full lobby turns the next player away
+	for i := 0; i <= lobby.AllowedObservers; i++ {
+		h.join(h.nk.AddUser(fmt.Sprintf("observer-%d", i), "Observer"), deltaClient)
+	}
+	if n := h.nk.Counters[nakamatest.MetricKey(metricJoinRejections, map[string]string{"mode": "deathmatch", "region": lobby.Region, "reason": rejectFull})]; n != 1 {
+		t.Errorf("full rejections = %v, counters %v", n, h.nk.Counters)
+	}
+}
+
+func TestEmptyLobbyMetrics(t *testing.T) {
+	tags := map[string]string{"mode": "deathmatch", "region": regionNone}
+
+	h := newLobbyHarness(t, nil)
+	h.init("host", protocol.LobbySettings{})
+	host := h.nk.AddUser("host", "Host")
+	h.join(host, deltaClient)
+	h.loop()
+	h.leave(host)
+	for h.state != nil {
+		h.loop()
+	}
+
+	if n := h.nk.Counters[nakamatest.MetricKey(metricEmptyTerminations, tags)]; n != 1 {
+		t.Errorf("empty terminations = %v", n)
+	}
+	for key, n := range h.nk.Gauges {
+		if n != 0 {
+			t.Errorf("gauge %s = %v after the lobby ended", key, n)
+		}
+	}
+}
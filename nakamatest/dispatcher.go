@@ -0,0 +1,104 @@
+package nakamatest
+
+import (
+	"sync"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+// Broadcast is a message a match sent. Presences is nil when it went to
+// everyone in the match.
+type Broadcast struct {
+	OpCode    int64
+	Data      []byte
+	Presences []runtime.Presence
+	Deferred  bool
+}
+
+// SentTo reports whether the broadcast reached the session.
+func (b Broadcast) SentTo(sessionId string) bool {
+	if b.Presences == nil {
+		return true
+	}
+	for _, p := range b.Presences {
+		if p.GetSessionId() == sessionId {
+			return true
+		}
+	}
+	return false
+}
+
+// Dispatcher records everything a match asks it to do.
+type Dispatcher struct {
+	mu         sync.Mutex
+	Broadcasts []Broadcast
+	Labels     []string
+	Kicked     []runtime.Presence
+}
+
+var _ runtime.MatchDispatcher = (*Dispatcher)(nil)
+
+func (d *Dispatcher) BroadcastMessage(opCode int64, data []byte, presences []runtime.Presence, sender runtime.Presence, reliable bool) error {
+	d.record(Broadcast{OpCode: opCode, Data: data, Presences: presences})
+	return nil
+}
+
+func (d *Dispatcher) BroadcastMessageDeferred(opCode int64, data []byte, presences []runtime.Presence, sender runtime.Presence, reliable bool) error {
+	d.record(Broadcast{OpCode: opCode, Data: data, Presences: presences, Deferred: true})
+	return nil
+}
+
+func (d *Dispatcher) MatchKick(presences []runtime.Presence) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.Kicked = append(d.Kicked, presences...)
+	return nil
+}
+
+func (d *Dispatcher) MatchLabelUpdate(label string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.Labels = append(d.Labels, label)
+	return nil
+}
+
+func (d *Dispatcher) record(b Broadcast) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.Broadcasts = append(d.Broadcasts, b)
+}
+
+// Label is the most recent label, or "" if the match never set one.
+func (d *Dispatcher) Label() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.Labels) == 0 {
+		return ""
+	}
+	return d.Labels[len(d.Labels)-1]
+}
+
+// Received returns the broadcasts with the opcode that reached the session,
+// oldest first.
+func (d *Dispatcher) Received(sessionId string, opCode int64) []Broadcast {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	received := make([]Broadcast, 0)
+	for _, b := range d.Broadcasts {
+		if b.OpCode == opCode && b.SentTo(sessionId) {
+			received = append(received, b)
+		}
+	}
+	return received
+}
+
+// Reset forgets everything recorded so far, so a test can check only what
+// happens next.
+func (d *Dispatcher) Reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.Broadcasts = nil
+	d.Labels = nil
+	d.Kicked = nil
+}
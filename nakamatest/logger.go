@@ -0,0 +1,98 @@
+package nakamatest
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+type Entry struct {
+	Level   string
+	Message string
+}
+
+// Logger keeps every line logged through it, and writes them to the test log
+// so they show up when a test fails.
+type Logger struct {
+	t       testing.TB
+	mu      *sync.Mutex
+	entries *[]Entry
+	fields  map[string]interface{}
+}
+
+var _ runtime.Logger = (*Logger)(nil)
+
+func NewLogger(t testing.TB) *Logger {
+	return &Logger{
+		t:       t,
+		mu:      &sync.Mutex{},
+		entries: &[]Entry{},
+		fields:  map[string]interface{}{},
+	}
+}
+
+func (l *Logger) log(level string, format string, v ...interface{}) {
+	message := fmt.Sprintf(format, v...)
+
+	l.mu.Lock()
+	*l.entries = append(*l.entries, Entry{Level: level, Message: message})
+	l.mu.Unlock()
+
+	if l.t != nil {
+		l.t.Helper()
+		l.t.Logf("%s %s", level, message)
+	}
+}
+
+func (l *Logger) Debug(format string, v ...interface{}) { l.log("DEBUG", format, v...) }
+func (l *Logger) Info(format string, v ...interface{})  { l.log("INFO", format, v...) }
+func (l *Logger) Warn(format string, v ...interface{})  { l.log("WARN", format, v...) }
+func (l *Logger) Error(format string, v ...interface{}) { l.log("ERROR", format, v...) }
+
+// Loggers made with fields share their parent's entries.
+func (l *Logger) WithField(key string, v interface{}) runtime.Logger {
+	return l.WithFields(map[string]interface{}{key: v})
+}
+
+func (l *Logger) WithFields(fields map[string]interface{}) runtime.Logger {
+	merged := make(map[string]interface{}, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &Logger{t: l.t, mu: l.mu, entries: l.entries, fields: merged}
+}
+
+func (l *Logger) Fields() map[string]interface{} {
+	return l.fields
+}
+
+// Entries returns every line logged at the level, or at any level if level
+// is "".
+func (l *Logger) Entries(level string) []Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries := make([]Entry, 0)
+	for _, e := range *l.entries {
+		if level == "" || e.Level == level {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// Contains reports whether any line at the level includes text.
+func (l *Logger) Contains(level string, text string) bool {
+	for _, e := range l.Entries(level) {
+		if strings.Contains(e.Message, text) {
+			return true
+		}
+	}
+	return false
+}
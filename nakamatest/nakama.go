@@ -0,0 +1,380 @@
+package nakamatest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/api"
+	"github.com/heroiclabs/nakama-common/runtime"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// Nakama's friend state for a blocked user
+const friendStateBlocked = 3
+
+// CreatedMatch is a MatchCreate call.
+type CreatedMatch struct {
+	MatchId string
+	Module  string
+	Params  map[string]interface{}
+}
+
+// NakamaModule fakes the parts of runtime.NakamaModule the lobby uses: users,
+// block lists, storage, wallets, match creation, listing, lookup and signals,
+// metrics and events. Calling anything else panics, since the embedded module is nil.
+type NakamaModule struct {
+	runtime.NakamaModule
+
+	mu sync.Mutex
+	// Users by ID
+	Users map[string]*api.User
+	// The user IDs each user has blocked
+	Blocked map[string][]string
+	// Storage objects by collection, key and owner
+	Storage map[string]*api.StorageObject
+	Wallets map[string]map[string]int64
+
+	Created []CreatedMatch
+	// Returned by MatchList, filtered by the query's required label terms
+	// unless MatchListFunc is set
+	Matches       []*api.Match
+	MatchListFunc func(limit int, authoritative bool, label string, query string) []*api.Match
+	Signals       map[string][]string
+
+	Counters map[string]int64
+	Gauges   map[string]float64
+	Timers   map[string][]time.Duration
+
+	Events []*api.Event
+}
+
+var _ runtime.NakamaModule = (*NakamaModule)(nil)
+
+func NewNakamaModule() *NakamaModule {
+	return &NakamaModule{
+		Users:    make(map[string]*api.User),
+		Blocked:  make(map[string][]string),
+		Storage:  make(map[string]*api.StorageObject),
+		Wallets:  make(map[string]map[string]int64),
+		Signals:  make(map[string][]string),
+		Counters: make(map[string]int64),
+		Gauges:   make(map[string]float64),
+		Timers:   make(map[string][]time.Duration),
+	}
+}
+
+// AddUser registers a user and returns a presence for a new session of
+// theirs.
+func (n *NakamaModule) AddUser(userId string, displayName string) *Presence {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.Users[userId] = &api.User{Id: userId, Username: userId, DisplayName: displayName}
+	return &Presence{UserId: userId, SessionId: "session-" + userId, Username: userId, NodeId: "node"}
+}
+
+func (n *NakamaModule) UsersGetId(ctx context.Context, userIDs []string, facebookIDs []string) ([]*api.User, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	users := make([]*api.User, 0, len(userIDs))
+	for _, id := range userIDs {
+		if u, ok := n.Users[id]; ok {
+			users = append(users, u)
+		}
+	}
+	return users, nil
+}
+
+// FriendsList only knows about blocked users, which is all the lobby asks for.
+func (n *NakamaModule) FriendsList(ctx context.Context, userID string, limit int, state *int, cursor string) ([]*api.Friend, string, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	friends := make([]*api.Friend, 0)
+	if state != nil && *state != friendStateBlocked {
+		return friends, "", nil
+	}
+	for _, id := range n.Blocked[userID] {
+		friends = append(friends, &api.Friend{
+			User:  &api.User{Id: id},
+			State: wrapperspb.Int32(friendStateBlocked),
+		})
+	}
+	return friends, "", nil
+}
+
+func storageKey(collection, key, userId string) string {
+	return collection + "/" + key + "/" + userId
+}
+
+func (n *NakamaModule) StorageRead(ctx context.Context, reads []*runtime.StorageRead) ([]*api.StorageObject, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	objects := make([]*api.StorageObject, 0)
+	for _, r := range reads {
+		if o, ok := n.Storage[storageKey(r.Collection, r.Key, r.UserID)]; ok {
+			objects = append(objects, o)
+		}
+	}
+	return objects, nil
+}
+
+// StorageWrite honours versions: "*" only creates, and any other non-empty
+// version must match the stored one.
+func (n *NakamaModule) StorageWrite(ctx context.Context, writes []*runtime.StorageWrite) ([]*api.StorageObjectAck, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	acks := make([]*api.StorageObjectAck, 0, len(writes))
+	for _, w := range writes {
+		k := storageKey(w.Collection, w.Key, w.UserID)
+		existing, exists := n.Storage[k]
+		if w.Version == "*" && exists || w.Version != "" && w.Version != "*" && (!exists || existing.Version != w.Version) {
+			return nil, fmt.Errorf("storage write rejected - version check failed for %s", k)
+		}
+
+		version := "1"
+		if exists {
+			previous, _ := strconv.Atoi(existing.Version)
+			version = strconv.Itoa(previous + 1)
+		}
+		n.Storage[k] = &api.StorageObject{
+			Collection:      w.Collection,
+			Key:             w.Key,
+			UserId:          w.UserID,
+			Value:           w.Value,
+			Version:         version,
+			PermissionRead:  int32(w.PermissionRead),
+			PermissionWrite: int32(w.PermissionWrite),
+		}
+		acks = append(acks, &api.StorageObjectAck{Collection: w.Collection, Key: w.Key, Version: version, UserId: w.UserID})
+	}
+	return acks, nil
+}
+
+// StorageList pages through one user's objects in a collection in key order.
+// The cursor is the key to start after.
+func (n *NakamaModule) StorageList(ctx context.Context, callerID, userID, collection string, limit int, cursor string) ([]*api.StorageObject, string, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	objects := make([]*api.StorageObject, 0)
+	for _, o := range n.Storage {
+		if o.Collection == collection && o.UserId == userID && o.Key > cursor {
+			objects = append(objects, o)
+		}
+	}
+	sort.Slice(objects, func(a, b int) bool {
+		return objects[a].Key < objects[b].Key
+	})
+
+	next := ""
+	if len(objects) > limit {
+		objects = objects[:limit]
+		next = objects[limit-1].Key
+	}
+	return objects, next, nil
+}
+
+func (n *NakamaModule) StorageDelete(ctx context.Context, deletes []*runtime.StorageDelete) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, d := range deletes {
+		delete(n.Storage, storageKey(d.Collection, d.Key, d.UserID))
+	}
+	return nil
+}
+
+func (n *NakamaModule) WalletUpdate(ctx context.Context, userID string, changeset map[string]int64, metadata map[string]interface{}, updateLedger bool) (map[string]int64, map[string]int64, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	wallet := n.Wallets[userID]
+	previous := make(map[string]int64, len(wallet))
+	updated := make(map[string]int64, len(wallet))
+	for k, v := range wallet {
+		previous[k] = v
+		updated[k] = v
+	}
+	for k, delta := range changeset {
+		updated[k] += delta
+		if updated[k] < 0 {
+			return nil, nil, fmt.Errorf("wallet update rejected - negative %s", k)
+		}
+	}
+	n.Wallets[userID] = updated
+	return updated, previous, nil
+}
+
+// MatchCreate records the call and hands out sequential match IDs. The match
+// isn't run.
+func (n *NakamaModule) MatchCreate(ctx context.Context, module string, params map[string]interface{}) (string, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	matchId := fmt.Sprintf("match-%d.node", len(n.Created)+1)
+	n.Created = append(n.Created, CreatedMatch{MatchId: matchId, Module: module, Params: params})
+	return matchId, nil
+}
+
+func (n *NakamaModule) MatchList(ctx context.Context, limit int, authoritative bool, label string, minSize, maxSize *int, query string) ([]*api.Match, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var matches []*api.Match
+	if n.MatchListFunc != nil {
+		matches = n.MatchListFunc(limit, authoritative, label, query)
+	} else {
+		for _, m := range n.Matches {
+			ok, err := matchesQuery(m.GetLabel().GetValue(), query)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				matches = append(matches, m)
+			}
+		}
+	}
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return matches, nil
+}
+
+// matchesQuery checks a JSON label against the required terms of a match
+// listing query, which look like +label.field:value or +label.field:>=n. Only
+// as much of Nakama's query syntax as the lobby uses is understood.
+func matchesQuery(label string, query string) (bool, error) {
+	if query == "" || query == "*" {
+		return true, nil
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(label), &fields); err != nil {
+		return false, nil
+	}
+	for _, term := range strings.Fields(query) {
+		name, want, ok := strings.Cut(strings.TrimPrefix(term, "+label."), ":")
+		if !strings.HasPrefix(term, "+label.") || !ok {
+			return false, fmt.Errorf("unsupported query term %q", term)
+		}
+		value, ok := fields[name]
+		if !ok {
+			return false, nil
+		}
+
+		op := ""
+		for _, prefix := range []string{">=", "<=", ">", "<"} {
+			if strings.HasPrefix(want, prefix) {
+				op, want = prefix, strings.TrimPrefix(want, prefix)
+				break
+			}
+		}
+		if op == "" {
+			if fmt.Sprint(value) != want {
+				return false, nil
+			}
+			continue
+		}
+
+		have, isNumber := value.(float64)
+		bound, err := strconv.ParseFloat(want, 64)
+		if err != nil {
+			return false, fmt.Errorf("unsupported query term %q", term)
+		}
+		if !isNumber {
+			return false, nil
+		}
+		switch {
+		case op == ">=" && have < bound, op == "<=" && have > bound,
+			op == ">" && have <= bound, op == "<" && have >= bound:
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// AddMatch makes a match show up in MatchList.
+func (n *NakamaModule) AddMatch(matchId string, label string, size int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.Matches = append(n.Matches, &api.Match{
+		MatchId:       matchId,
+		Authoritative: true,
+		Label:         wrapperspb.String(label),
+		Size:          int32(size),
+	})
+}
+
+// MatchGet finds matches added with AddMatch, and returns nil for any other.
+func (n *NakamaModule) MatchGet(ctx context.Context, id string) (*api.Match, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, m := range n.Matches {
+		if m.MatchId == id {
+			return m, nil
+		}
+	}
+	return nil, nil
+}
+
+func (n *NakamaModule) MatchSignal(ctx context.Context, id string, data string) (string, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.Signals[id] = append(n.Signals[id], data)
+	return "", nil
+}
+
+// MetricKey is how metrics are keyed: the name followed by the tags in key
+// order, like "name,a=1,b=2".
+func MetricKey(name string, tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := []string{name}
+	for _, k := range keys {
+		parts = append(parts, k+"="+tags[k])
+	}
+	return strings.Join(parts, ",")
+}
+
+func (n *NakamaModule) MetricsCounterAdd(name string, tags map[string]string, delta int64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.Counters[MetricKey(name, tags)] += delta
+}
+
+func (n *NakamaModule) MetricsGaugeSet(name string, tags map[string]string, value float64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.Gauges[MetricKey(name, tags)] = value
+}
+
+func (n *NakamaModule) MetricsTimerRecord(name string, tags map[string]string, value time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	key := MetricKey(name, tags)
+	n.Timers[key] = append(n.Timers[key], value)
+}
+
+func (n *NakamaModule) Event(ctx context.Context, evt *api.Event) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.Events = append(n.Events, evt)
+	return nil
+}
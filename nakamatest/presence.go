@@ -0,0 +1,40 @@
+// Package nakamatest has in-memory fakes of the Nakama runtime, so match
+// handlers and rpcs can be driven from tests without a Nakama server.
+package nakamatest
+
+import "github.com/heroiclabs/nakama-common/runtime"
+
+// Presence is a session in a match. Only the IDs and username are used by
+// the lobby, the rest are there to satisfy runtime.Presence.
+type Presence struct {
+	UserId    string
+	SessionId string
+	Username  string
+	NodeId    string
+}
+
+var _ runtime.Presence = (*Presence)(nil)
+
+func (p *Presence) GetHidden() bool                   { return false }
+func (p *Presence) GetPersistence() bool              { return false }
+func (p *Presence) GetUsername() string               { return p.Username }
+func (p *Presence) GetStatus() string                 { return "" }
+func (p *Presence) GetReason() runtime.PresenceReason { return runtime.PresenceReasonUnknown }
+func (p *Presence) GetUserId() string                 { return p.UserId }
+func (p *Presence) GetSessionId() string              { return p.SessionId }
+func (p *Presence) GetNodeId() string                 { return p.NodeId }
+
+// MatchData is a message from Presence to the match.
+type MatchData struct {
+	*Presence
+	OpCode      int64
+	Data        []byte
+	ReceiveTime int64
+}
+
+var _ runtime.MatchData = (*MatchData)(nil)
+
+func (d *MatchData) GetOpCode() int64      { return d.OpCode }
+func (d *MatchData) GetData() []byte       { return d.Data }
+func (d *MatchData) GetReliable() bool     { return true }
+func (d *MatchData) GetReceiveTime() int64 { return d.ReceiveTime }
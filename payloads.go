@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"imps/mpserver/protocol"
+)
+
+// Room for a full length Nakama display name plus the decoration create-lobby
+// adds to it
+const maxMatchNameLength = 300
+
+// Nakama match IDs are a UUID plus the node name
+const maxMatchIdLength = 128
+
+type CreateLobbyRequest struct {
+	IsPrivate bool `json:"isPrivate"`
+	// Anything left out, including the whole object, gets the mode's default
+	Settings *protocol.LobbySettings `json:"settings"`
+}
+
+func (r *CreateLobbyRequest) validate(errs *fieldErrors) {
+	modes := currentGameModes()
+	validateSettings(errs, "settings", modes, r.settings(modes))
+}
+
+// settings returns the requested settings with the defaults filled in.
+func (r *CreateLobbyRequest) settings(modes *gameModeCatalog) protocol.LobbySettings {
+	if r.Settings == nil {
+		return withDefaults(modes, protocol.LobbySettings{})
+	}
+	return withDefaults(modes, *r.Settings)
+}
+
+type FindMatchRequest struct {
+	// Defaults to the catalog's default mode
+	Mode string `json:"mode"`
+}
+
+func (r *FindMatchRequest) validate(errs *fieldErrors) {
+	modes := currentGameModes()
+	if _, ok := modes.Modes[r.mode(modes)]; !ok {
+		errs.add("mode", "must be one of %s", strings.Join(modes.modeNames(), ", "))
+	}
+}
+
+func (r *FindMatchRequest) mode(modes *gameModeCatalog) string {
+	if r.Mode == "" {
+		return modes.DefaultMode
+	}
+	return r.Mode
+}
+
+type GameEndedRequest struct {
+	MatchId string `json:"matchId"`
+}
+
+func (r *GameEndedRequest) validate(errs *fieldErrors) {
+	validateMatchId(errs, "matchId", r.MatchId)
+}
+
+type ResolveMatchRequest struct {
+	// The match ID the lobby was created with
+	MatchId string `json:"matchId"`
+}
+
+func (r *ResolveMatchRequest) validate(errs *fieldErrors) {
+	validateMatchId(errs, "matchId", r.MatchId)
+}
+
+// lobbyParams are the params create-lobby hands to MatchInit.
+type lobbyParams struct {
+	IsPrivate  bool                   `json:"isPrivate"`
+	MatchName  string                 `json:"matchName"`
+	HostUserId string                 `json:"hostUserId"`
+	Settings   protocol.LobbySettings `json:"settings"`
+	// Set instead of the rest when recoverLobbies brings back a lobby
+	Recovered *savedLobby `json:"recovered,omitempty"`
+}
+
+func (p *lobbyParams) validate(errs *fieldErrors) {
+	if p.Recovered != nil {
+		p.Recovered.validate(errs)
+		return
+	}
+	if utf8.RuneCountInString(p.MatchName) > maxMatchNameLength {
+		errs.add("matchName", "must be at most %d characters", maxMatchNameLength)
+	}
+	validateSettings(errs, "settings", currentGameModes(), p.Settings)
+}
+
+func validateMatchId(errs *fieldErrors, field string, matchId string) {
+	if matchId == "" {
+		errs.add(field, "is required")
+	} else if len(matchId) > maxMatchIdLength {
+		errs.add(field, "must be at most %d characters", maxMatchIdLength)
+	}
+}
@@ -0,0 +1,152 @@
+package protocol
+
+import "encoding/json"
+
+// Ready is sent by a player once they are ready to start. It has no fields.
+type Ready struct{}
+
+// RegionLatency reports a player's round trip time to each region, in
+// milliseconds. It can also be sent up front as the latencies join metadata.
+type RegionLatency struct {
+	Latencies map[string]int `json:"latencies"`
+}
+
+// ResyncRequest asks for a full LobbyUpdate, for when a client sees a gap in
+// the LobbyDelta sequence numbers. It has no fields.
+type ResyncRequest struct{}
+
+// ChatSend is a chat message from a player to the rest of the lobby.
+type ChatSend struct {
+	Text string `json:"text"`
+}
+
+// ChatMute lets the host mute or unmute a player's chat.
+type ChatMute struct {
+	UserId string `json:"userId"`
+	Muted  bool   `json:"muted"`
+}
+
+// LobbySettings configures the game a lobby will play. TimeLimit is in
+// seconds, and Rules holds the mode's own options, which are checked against
+// the mode's rule schema. The host sends it to change the settings, and
+// everyone gets the current settings in LobbyUpdate.
+type LobbySettings struct {
+	Mode      string            `json:"mode"`
+	Map       string            `json:"map"`
+	TimeLimit int               `json:"timeLimit"`
+	Rules     map[string]string `json:"rules"`
+}
+
+// PlayerReady tells everyone in the lobby that a player readied up.
+type PlayerReady struct {
+	Version   int    `json:"version"`
+	SessionId string `json:"sessionId"`
+}
+
+// LobbyUpdate is the full lobby roster as of Sequence. It is sent to players
+// when they join and when they ask to resync, and deltas with a higher
+// sequence number apply on top of it.
+type LobbyUpdate struct {
+	Version    int           `json:"version"`
+	Sequence   int64         `json:"sequence"`
+	Players    []LobbyPlayer `json:"players"`
+	HostUserId string        `json:"hostUserId"`
+	Settings   LobbySettings `json:"settings"`
+}
+
+// LobbyDelta is a single change to the roster. Sequence goes up by exactly one
+// with each delta, so a client that sees a gap should send a ResyncRequest.
+type LobbyDelta struct {
+	Version  int         `json:"version"`
+	Sequence int64       `json:"sequence"`
+	Event    string      `json:"event"`
+	Player   LobbyPlayer `json:"player"`
+}
+
+type LobbyPlayer struct {
+	SessionId   string `json:"sessionId"`
+	UserId      string `json:"userId"`
+	DisplayName string `json:"displayName"`
+	IsReady     bool   `json:"isReady"`
+	IsObserving bool   `json:"isObserving"`
+	SlotNumber  int    `json:"slotNumber"`
+}
+
+// GameStart tells the lobby its game server is up. Server is the server
+// manager's allocation response, passed through untouched. Version 1 clients
+// get the response's own fields in JSON instead, with region added.
+type GameStart struct {
+	Version int             `json:"version"`
+	Region  string          `json:"region"`
+	Server  json.RawMessage `json:"server"`
+}
+
+// ChatMessage is a chat message relayed to the lobby, after filtering. SentAt
+// is when the server received it, in milliseconds since the Unix epoch.
+type ChatMessage struct {
+	Version     int    `json:"version"`
+	UserId      string `json:"userId"`
+	DisplayName string `json:"displayName"`
+	Text        string `json:"text"`
+	SentAt      int64  `json:"sentAt"`
+}
+
+// ChatHistory is the recent chat, oldest first, sent to players when they
+// join.
+type ChatHistory struct {
+	Version  int           `json:"version"`
+	Messages []ChatMessage `json:"messages"`
+}
+
+// QueuePosition is the lobby's one-based place in line for a game server, or
+// zero once it has left the queue.
+type QueuePosition struct {
+	Version  int `json:"version"`
+	Position int `json:"position"`
+}
+
+// ServerShutdown warns that the server is shutting down in GraceSeconds. Games
+// in progress carry on, and their lobby comes back after the restart when
+// Resumes is set. Other lobbies close, so players should find a new one.
+type ServerShutdown struct {
+	Version      int  `json:"version"`
+	GraceSeconds int  `json:"graceSeconds"`
+	Resumes      bool `json:"resumes"`
+}
+
+// Maintenance announces planned maintenance to a lobby that hasn't launched.
+// The server goes down in StartsInSeconds, counted from when the message was
+// sent, so the lobby should launch before then or players should come back
+// later. Active is false once the maintenance is called off.
+type Maintenance struct {
+	Version         int    `json:"version"`
+	Active          bool   `json:"active"`
+	Message         string `json:"message"`
+	StartsInSeconds int    `json:"startsInSeconds"`
+}
+
+// ErrorMessage reports a problem to the player or players it affects. Code is
+// one of the ErrorCode constants and Message is meant for humans.
+type ErrorMessage struct {
+	Version int    `json:"version"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// LobbyLabel is the match label, which clients search and read through the
+// match listing API. Booleans are strings so they can be matched in label
+// queries. OpenSlots counts the player and observer slots nobody has taken or
+// reserved, so a lobby that CanJoin may still have no room.
+type LobbyLabel struct {
+	Version     int    `json:"version"`
+	IsPrivate   string `json:"isPrivate"`
+	PlayerCount int    `json:"playerCount"`
+	MatchName   string `json:"matchName"`
+	CanJoin     string `json:"canJoin"`
+	OpenSlots   int    `json:"openSlots"`
+	Region      string `json:"region"`
+	Mode        string `json:"mode"`
+	Map         string `json:"map"`
+	TimeLimit   int    `json:"timeLimit"`
+	Ranked      string `json:"ranked"`
+}
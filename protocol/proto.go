@@ -0,0 +1,213 @@
+package protocol
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+
+	"imps/mpserver/protocol/lobbypb"
+)
+
+// lobbypb is generated from lobby.proto by protoc-gen-go v1.31.0, the version
+// in go.mod, so run go generate with that after changing lobby.proto.
+//go:generate protoc --go_out=.. --go_opt=module=imps/mpserver lobby.proto
+
+// Encodings a client can ask for with the EncodingMetadataKey join metadata.
+const (
+	EncodingJSON     = "json"
+	EncodingProtobuf = "protobuf"
+)
+
+// EncodingMetadataKey is the join metadata key clients put their preferred
+// encoding under. Clients that leave it out get JSON.
+const EncodingMetadataKey = "encoding"
+
+// Message is implemented by every outbound message, so it can be sent in
+// whichever encoding and version the client asked for.
+type Message interface {
+	MarshalProto() ([]byte, error)
+	// ForVersion is the message as a client speaking version expects it.
+	ForVersion(version int) Message
+}
+
+func NegotiateEncoding(metadata map[string]string) (string, error) {
+	encoding, ok := metadata[EncodingMetadataKey]
+	if !ok {
+		return EncodingJSON, nil
+	}
+	if encoding != EncodingJSON && encoding != EncodingProtobuf {
+		return "", fmt.Errorf("unsupported encoding %q, server supports %s and %s", encoding, EncodingJSON, EncodingProtobuf)
+	}
+	return encoding, nil
+}
+
+// Each message is copied into its lobbypb counterpart to be encoded, and
+// inbound ones are copied back out, so the JSON types stay the ones the rest
+// of the server and cmd/bindgen work with.
+
+func (m PlayerReady) MarshalProto() ([]byte, error) {
+	return proto.Marshal(&lobbypb.PlayerReady{
+		Version:   int32(m.Version),
+		SessionId: m.SessionId,
+	})
+}
+
+func (m LobbyUpdate) MarshalProto() ([]byte, error) {
+	players := make([]*lobbypb.LobbyPlayer, 0, len(m.Players))
+	for _, p := range m.Players {
+		players = append(players, p.toProto())
+	}
+	return proto.Marshal(&lobbypb.LobbyUpdate{
+		Version:    int32(m.Version),
+		Players:    players,
+		Sequence:   m.Sequence,
+		HostUserId: m.HostUserId,
+		Settings:   m.Settings.toProto(),
+	})
+}
+
+func (m LobbyDelta) MarshalProto() ([]byte, error) {
+	return proto.Marshal(&lobbypb.LobbyDelta{
+		Version:  int32(m.Version),
+		Sequence: m.Sequence,
+		Event:    m.Event,
+		Player:   m.Player.toProto(),
+	})
+}
+
+func (m ChatMessage) MarshalProto() ([]byte, error) {
+	return proto.Marshal(m.toProto())
+}
+
+func (m ChatHistory) MarshalProto() ([]byte, error) {
+	messages := make([]*lobbypb.ChatMessage, 0, len(m.Messages))
+	for _, message := range m.Messages {
+		messages = append(messages, message.toProto())
+	}
+	return proto.Marshal(&lobbypb.ChatHistory{
+		Version:  int32(m.Version),
+		Messages: messages,
+	})
+}
+
+func (m GameStart) MarshalProto() ([]byte, error) {
+	return proto.Marshal(&lobbypb.GameStart{
+		Version: int32(m.Version),
+		Region:  m.Region,
+		Server:  string(m.Server),
+	})
+}
+
+func (m QueuePosition) MarshalProto() ([]byte, error) {
+	return proto.Marshal(&lobbypb.QueuePosition{
+		Version:  int32(m.Version),
+		Position: int32(m.Position),
+	})
+}
+
+func (m ServerShutdown) MarshalProto() ([]byte, error) {
+	return proto.Marshal(&lobbypb.ServerShutdown{
+		Version:      int32(m.Version),
+		GraceSeconds: int32(m.GraceSeconds),
+		Resumes:      m.Resumes,
+	})
+}
+
+func (m Maintenance) MarshalProto() ([]byte, error) {
+	return proto.Marshal(&lobbypb.Maintenance{
+		Version:         int32(m.Version),
+		Active:          m.Active,
+		Message:         m.Message,
+		StartsInSeconds: int32(m.StartsInSeconds),
+	})
+}
+
+func (m ErrorMessage) MarshalProto() ([]byte, error) {
+	return proto.Marshal(&lobbypb.ErrorMessage{
+		Version: int32(m.Version),
+		Code:    m.Code,
+		Message: m.Message,
+	})
+}
+
+func (m LobbyPlayer) toProto() *lobbypb.LobbyPlayer {
+	return &lobbypb.LobbyPlayer{
+		SessionId:   m.SessionId,
+		UserId:      m.UserId,
+		DisplayName: m.DisplayName,
+		IsReady:     m.IsReady,
+		IsObserving: m.IsObserving,
+		SlotNumber:  int32(m.SlotNumber),
+	}
+}
+
+func (m LobbySettings) toProto() *lobbypb.LobbySettings {
+	return &lobbypb.LobbySettings{
+		Mode:      m.Mode,
+		Map:       m.Map,
+		TimeLimit: int32(m.TimeLimit),
+		Rules:     m.Rules,
+	}
+}
+
+func (m ChatMessage) toProto() *lobbypb.ChatMessage {
+	return &lobbypb.ChatMessage{
+		Version:     int32(m.Version),
+		UserId:      m.UserId,
+		DisplayName: m.DisplayName,
+		Text:        m.Text,
+		SentAt:      m.SentAt,
+	}
+}
+
+// UnmarshalProto decodes an inbound protobuf message into v, which must be a
+// pointer to one of the inbound message types. Unknown fields, and known ones
+// sent with the wrong wire type, are skipped as proto3 does, so clients built
+// against a newer lobby.proto can still talk to this server.
+func UnmarshalProto(data []byte, v interface{}) error {
+	switch v := v.(type) {
+	case *Ready:
+		return proto.Unmarshal(data, &lobbypb.Ready{})
+	case *ResyncRequest:
+		return proto.Unmarshal(data, &lobbypb.ResyncRequest{})
+	case *ChatSend:
+		var m lobbypb.ChatSend
+		if err := proto.Unmarshal(data, &m); err != nil {
+			return err
+		}
+		v.Text = m.Text
+		return nil
+	case *ChatMute:
+		var m lobbypb.ChatMute
+		if err := proto.Unmarshal(data, &m); err != nil {
+			return err
+		}
+		v.UserId = m.UserId
+		v.Muted = m.Muted
+		return nil
+	case *LobbySettings:
+		var m lobbypb.LobbySettings
+		if err := proto.Unmarshal(data, &m); err != nil {
+			return err
+		}
+		v.Mode = m.Mode
+		v.Map = m.Map
+		v.TimeLimit = int(m.TimeLimit)
+		v.Rules = make(map[string]string, len(m.Rules))
+		for key, value := range m.Rules {
+			v.Rules[key] = value
+		}
+		return nil
+	case *RegionLatency:
+		var m lobbypb.RegionLatency
+		if err := proto.Unmarshal(data, &m); err != nil {
+			return err
+		}
+		v.Latencies = make(map[string]int, len(m.Latencies))
+		for region, latency := range m.Latencies {
+			v.Latencies[region] = int(latency)
+		}
+		return nil
+	}
+	return fmt.Errorf("%T is not an inbound message", v)
+}
@@ -0,0 +1,191 @@
+package protocol
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+
+	"imps/mpserver/protocol/lobbypb"
+)
+
+// Messages only ever sent as JSON, which lobby.proto leaves out
+var jsonOnly = map[string]bool{"LobbyLabel": true}
+
+// Messages only ever sent inside others, so covered by those
+var nestedOnly = map[string]bool{"LobbyPlayer": true}
+
+// Every message in the registry is checked against the types generated from
+// lobby.proto: what MarshalProto writes has to decode to the same values, and
+// what a client encodes from lobby.proto has to come out of UnmarshalProto
+// unchanged, fields it doesn't know about included.
+func TestProtoMatchesLobbyProto(t *testing.T) {
+	file := lobbypb.File_lobby_proto
+
+	for _, m := range Messages {
+		typ := reflect.TypeOf(m)
+		desc := file.Messages().ByName(protoreflect.Name(typ.Name()))
+		if jsonOnly[typ.Name()] {
+			if desc != nil {
+				t.Errorf("%s is in lobby.proto but only sent as JSON", typ.Name())
+			}
+			continue
+		}
+		if desc == nil {
+			t.Errorf("%s is missing from lobby.proto", typ.Name())
+			continue
+		}
+
+		t.Run(typ.Name(), func(t *testing.T) {
+			messageType, err := protoregistry.GlobalTypes.FindMessageByName(desc.FullName())
+			if err != nil {
+				t.Fatal(err)
+			}
+			sample := reflect.New(typ)
+			fillSample(sample.Elem(), new(int))
+			want := messageType.New()
+			toProto(t, sample.Elem(), want)
+
+			outbound, isOutbound := sample.Elem().Interface().(Message)
+			if isOutbound {
+				encoded, err := outbound.MarshalProto()
+				if err != nil {
+					t.Fatalf("MarshalProto: %v", err)
+				}
+				got := messageType.New()
+				if err := proto.Unmarshal(encoded, got.Interface()); err != nil {
+					t.Fatalf("MarshalProto output doesn't decode: %v", err)
+				}
+				if !proto.Equal(got.Interface(), want.Interface()) {
+					t.Errorf("MarshalProto encodes %v, want %v", got.Interface(), want.Interface())
+				}
+			}
+
+			data, err := proto.Marshal(want.Interface())
+			if err != nil {
+				t.Fatal(err)
+			}
+			// A newer client may send fields this server doesn't know about
+			data = protowire.AppendTag(data, 100, protowire.VarintType)
+			data = protowire.AppendVarint(data, 7)
+			data = protowire.AppendTag(data, 101, protowire.BytesType)
+			data = protowire.AppendString(data, "from the future")
+
+			decoded := reflect.New(typ)
+			err = UnmarshalProto(data, decoded.Interface())
+			switch {
+			case err != nil && strings.HasSuffix(err.Error(), "is not an inbound message"):
+				if !isOutbound && !nestedOnly[typ.Name()] {
+					t.Errorf("%s is neither sent nor received", typ.Name())
+				}
+			case err != nil:
+				t.Errorf("UnmarshalProto: %v", err)
+			case !reflect.DeepEqual(decoded.Elem().Interface(), sample.Elem().Interface()):
+				t.Errorf("UnmarshalProto decoded %+v, want %+v", decoded.Elem().Interface(), sample.Elem().Interface())
+			}
+		})
+	}
+}
+
+// fillSample sets every field of v to a value no other field has, so fields
+// that swapped places would show up.
+func fillSample(v reflect.Value, next *int) {
+	*next++
+	switch v.Kind() {
+	case reflect.Int, reflect.Int64:
+		v.SetInt(int64(*next))
+	case reflect.Bool:
+		v.SetBool(*next%2 == 0)
+	case reflect.String:
+		v.SetString(fmt.Sprintf("value %d", *next))
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			v.SetBytes([]byte(fmt.Sprintf(`{"value":%d}`, *next)))
+			return
+		}
+		v.Set(reflect.MakeSlice(v.Type(), 2, 2))
+		for i := 0; i < v.Len(); i++ {
+			fillSample(v.Index(i), next)
+		}
+	case reflect.Map:
+		v.Set(reflect.MakeMap(v.Type()))
+		for i := 0; i < 2; i++ {
+			key := reflect.New(v.Type().Key()).Elem()
+			value := reflect.New(v.Type().Elem()).Elem()
+			fillSample(key, next)
+			fillSample(value, next)
+			v.SetMapIndex(key, value)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			fillSample(v.Field(i), next)
+		}
+	default:
+		panic(fmt.Sprintf("no sample value for %s", v.Type()))
+	}
+}
+
+// toProto copies the struct v into m, pairing fields up by their JSON
+// names, and fails the test when the two don't have the same fields.
+func toProto(t *testing.T, v reflect.Value, m protoreflect.Message) {
+	t.Helper()
+
+	desc := m.Descriptor()
+	for i := 0; i < v.NumField(); i++ {
+		name := strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0]
+		fd := desc.Fields().ByJSONName(name)
+		if fd == nil {
+			t.Errorf("%s.%s has no field in lobby.proto", v.Type().Name(), v.Type().Field(i).Name)
+			continue
+		}
+
+		field := v.Field(i)
+		switch {
+		case fd.IsMap():
+			entries := m.Mutable(fd).Map()
+			iter := field.MapRange()
+			for iter.Next() {
+				entries.Set(scalarValue(t, iter.Key(), fd.MapKey()).MapKey(), scalarValue(t, iter.Value(), fd.MapValue()))
+			}
+		case fd.IsList():
+			list := m.Mutable(fd).List()
+			for j := 0; j < field.Len(); j++ {
+				element := list.NewElement()
+				toProto(t, field.Index(j), element.Message())
+				list.Append(element)
+			}
+		case fd.Message() != nil:
+			toProto(t, field, m.Mutable(fd).Message())
+		default:
+			m.Set(fd, scalarValue(t, field, fd))
+		}
+	}
+	if v.NumField() != desc.Fields().Len() {
+		t.Errorf("%s has %d fields, lobby.proto has %d", v.Type().Name(), v.NumField(), desc.Fields().Len())
+	}
+}
+
+func scalarValue(t *testing.T, v reflect.Value, fd protoreflect.FieldDescriptor) protoreflect.Value {
+	t.Helper()
+
+	switch {
+	case fd.Kind() == protoreflect.Int32Kind && v.Kind() == reflect.Int:
+		return protoreflect.ValueOfInt32(int32(v.Int()))
+	case fd.Kind() == protoreflect.Int64Kind && v.Kind() == reflect.Int64:
+		return protoreflect.ValueOfInt64(v.Int())
+	case fd.Kind() == protoreflect.BoolKind && v.Kind() == reflect.Bool:
+		return protoreflect.ValueOfBool(v.Bool())
+	case fd.Kind() == protoreflect.StringKind && v.Kind() == reflect.String:
+		return protoreflect.ValueOfString(v.String())
+	case fd.Kind() == protoreflect.StringKind && v.Kind() == reflect.Slice:
+		// Raw JSON, such as GameStart.Server
+		return protoreflect.ValueOfString(string(v.Bytes()))
+	}
+	t.Fatalf("%s is %s in lobby.proto, which a Go %s can't hold", fd.FullName(), fd.Kind(), v.Type())
+	return protoreflect.Value{}
+}
@@ -0,0 +1,84 @@
+// Package protocol defines the messages exchanged between lobby clients and
+// the LobbyMatch handler. Every opcode payload and the match label have a
+// struct here, and clients should treat this package as the source of truth
+// for field names and types.
+package protocol
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Version is the protocol version the server speaks. Bump it whenever a
+// message changes in a way older clients can't cope with, and raise
+// MinVersion once the server stops supporting the old shape.
+const Version = 2
+
+// MinVersion is the oldest protocol version the server still accepts.
+const MinVersion = 1
+
+// DeltaVersion is the first protocol version that gets LobbyDelta events.
+// Older clients get a full LobbyUpdate every time the lobby changes instead.
+const DeltaVersion = 2
+
+// VersionMetadataKey is the join metadata key clients put their protocol
+// version under. Clients that leave it out are assumed to speak MinVersion.
+const VersionMetadataKey = "protocolVersion"
+
+// Opcodes for lobby match data. Each comment names the payload sent with it,
+// from client to server (inbound) and from server to client (outbound).
+const (
+	OP_READY           = 1  // inbound Ready, outbound PlayerReady
+	OP_LOBBY_UPDATE    = 2  // outbound LobbyUpdate
+	OP_GAME_START      = 3  // outbound GameStart
+	OP_REGION_LATENCY  = 4  // inbound RegionLatency
+	OP_QUEUE_POSITION  = 5  // outbound QueuePosition
+	OP_ERROR           = 6  // outbound ErrorMessage
+	OP_LOBBY_DELTA     = 7  // outbound LobbyDelta
+	OP_RESYNC_REQUEST  = 8  // inbound ResyncRequest
+	OP_CHAT_SEND       = 9  // inbound ChatSend
+	OP_CHAT_MESSAGE    = 10 // outbound ChatMessage
+	OP_CHAT_HISTORY    = 11 // outbound ChatHistory
+	OP_CHAT_MUTE       = 12 // inbound ChatMute
+	OP_LOBBY_SETTINGS  = 13 // inbound LobbySettings
+	OP_SERVER_SHUTDOWN = 14 // outbound ServerShutdown
+	OP_MAINTENANCE     = 15 // outbound Maintenance
+)
+
+// Error codes sent in ErrorMessage messages
+const (
+	ErrorCodeUnknownPlayer  = "unknown_player"
+	ErrorCodeBadMessage     = "bad_message"
+	ErrorCodeLaunchFailed   = "launch_failed"
+	ErrorCodeLobbyClosed    = "lobby_closed"
+	ErrorCodeRateLimited    = "rate_limited"
+	ErrorCodeMuted          = "muted"
+	ErrorCodeNotHost        = "not_host"
+	ErrorCodeSettingsLocked = "settings_locked"
+)
+
+// Events sent in LobbyDelta messages
+const (
+	LobbyEventJoined  = "joined"
+	LobbyEventLeft    = "left"
+	LobbyEventReadied = "readied"
+	LobbyEventMoved   = "moved" // slot or observer status changed
+)
+
+// NegotiateVersion works out which protocol version to speak with a client
+// from the version it put in its join metadata.
+func NegotiateVersion(metadata map[string]string) (int, error) {
+	requested, ok := metadata[VersionMetadataKey]
+	if !ok {
+		return MinVersion, nil
+	}
+
+	version, err := strconv.Atoi(requested)
+	if err != nil {
+		return 0, fmt.Errorf("protocol version %q is not a number", requested)
+	}
+	if version < MinVersion || version > Version {
+		return 0, fmt.Errorf("unsupported protocol version %d, server supports %d to %d", version, MinVersion, Version)
+	}
+	return version, nil
+}
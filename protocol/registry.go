@@ -0,0 +1,93 @@
+package protocol
+
+// The registry lists everything cmd/bindgen generates client bindings for.
+// Anything added to the protocol has to be added here too, or the C# and
+// TypeScript clients won't see it.
+
+//go:generate go run ../cmd/bindgen -out ../bindings
+
+type NamedValue struct {
+	Name  string
+	Value interface{}
+}
+
+var Constants = []NamedValue{
+	{"Version", Version},
+	{"MinVersion", MinVersion},
+	{"DeltaVersion", DeltaVersion},
+	{"VersionMetadataKey", VersionMetadataKey},
+	{"EncodingMetadataKey", EncodingMetadataKey},
+	{"EncodingJSON", EncodingJSON},
+	{"EncodingProtobuf", EncodingProtobuf},
+}
+
+var OpCodes = []NamedValue{
+	{"OP_READY", OP_READY},
+	{"OP_LOBBY_UPDATE", OP_LOBBY_UPDATE},
+	{"OP_GAME_START", OP_GAME_START},
+	{"OP_REGION_LATENCY", OP_REGION_LATENCY},
+	{"OP_QUEUE_POSITION", OP_QUEUE_POSITION},
+	{"OP_ERROR", OP_ERROR},
+	{"OP_LOBBY_DELTA", OP_LOBBY_DELTA},
+	{"OP_RESYNC_REQUEST", OP_RESYNC_REQUEST},
+	{"OP_CHAT_SEND", OP_CHAT_SEND},
+	{"OP_CHAT_MESSAGE", OP_CHAT_MESSAGE},
+	{"OP_CHAT_HISTORY", OP_CHAT_HISTORY},
+	{"OP_CHAT_MUTE", OP_CHAT_MUTE},
+	{"OP_LOBBY_SETTINGS", OP_LOBBY_SETTINGS},
+	{"OP_SERVER_SHUTDOWN", OP_SERVER_SHUTDOWN},
+	{"OP_MAINTENANCE", OP_MAINTENANCE},
+}
+
+var ErrorCodes = []NamedValue{
+	{"UnknownPlayer", ErrorCodeUnknownPlayer},
+	{"BadMessage", ErrorCodeBadMessage},
+	{"LaunchFailed", ErrorCodeLaunchFailed},
+	{"LobbyClosed", ErrorCodeLobbyClosed},
+	{"RateLimited", ErrorCodeRateLimited},
+	{"Muted", ErrorCodeMuted},
+	{"NotHost", ErrorCodeNotHost},
+	{"SettingsLocked", ErrorCodeSettingsLocked},
+}
+
+var LobbyEvents = []NamedValue{
+	{"Joined", LobbyEventJoined},
+	{"Left", LobbyEventLeft},
+	{"Readied", LobbyEventReadied},
+	{"Moved", LobbyEventMoved},
+}
+
+// StringGroup is a set of related string constants, emitted together as a
+// class or object named Name.
+type StringGroup struct {
+	Name   string
+	Values []NamedValue
+}
+
+var StringGroups = []StringGroup{
+	{"ErrorCodes", ErrorCodes},
+	{"LobbyEvents", LobbyEvents},
+}
+
+// Messages holds a zero value of every message struct, in the order they are
+// emitted. Structs only used as fields of other messages belong here too.
+var Messages = []interface{}{
+	Ready{},
+	RegionLatency{},
+	ResyncRequest{},
+	ChatSend{},
+	ChatMute{},
+	LobbySettings{},
+	PlayerReady{},
+	LobbyUpdate{},
+	LobbyDelta{},
+	LobbyPlayer{},
+	GameStart{},
+	ChatMessage{},
+	ChatHistory{},
+	QueuePosition{},
+	ServerShutdown{},
+	Maintenance{},
+	ErrorMessage{},
+	LobbyLabel{},
+}
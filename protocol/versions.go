@@ -0,0 +1,93 @@
+package protocol
+
+import "encoding/json"
+
+// ForVersion stamps each message with the version its recipient negotiated,
+// and reshapes it for versions that expect something different.
+
+func (m PlayerReady) ForVersion(version int) Message {
+	m.Version = version
+	return m
+}
+
+func (m LobbyUpdate) ForVersion(version int) Message {
+	m.Version = version
+	return m
+}
+
+func (m LobbyDelta) ForVersion(version int) Message {
+	m.Version = version
+	return m
+}
+
+// Version 1 clients get GameStart as the server manager's response with
+// region added to it, see legacyGameStart.
+func (m GameStart) ForVersion(version int) Message {
+	m.Version = version
+	if version < 2 {
+		return legacyGameStart(m)
+	}
+	return m
+}
+
+func (m ChatMessage) ForVersion(version int) Message {
+	m.Version = version
+	return m
+}
+
+func (m ChatHistory) ForVersion(version int) Message {
+	m.Version = version
+	messages := make([]ChatMessage, len(m.Messages))
+	for i, c := range m.Messages {
+		c.Version = version
+		messages[i] = c
+	}
+	m.Messages = messages
+	return m
+}
+
+func (m QueuePosition) ForVersion(version int) Message {
+	m.Version = version
+	return m
+}
+
+func (m ServerShutdown) ForVersion(version int) Message {
+	m.Version = version
+	return m
+}
+
+func (m Maintenance) ForVersion(version int) Message {
+	m.Version = version
+	return m
+}
+
+func (m ErrorMessage) ForVersion(version int) Message {
+	m.Version = version
+	return m
+}
+
+// legacyGameStart is GameStart as version 1 sent it in JSON: the fields of
+// the server manager's response, with region alongside them. Protobuf has
+// only ever had the GameStart shape.
+type legacyGameStart GameStart
+
+func (m legacyGameStart) MarshalJSON() ([]byte, error) {
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(m.Server, &fields); err != nil {
+		return nil, err
+	}
+	region, err := json.Marshal(m.Region)
+	if err != nil {
+		return nil, err
+	}
+	fields["region"] = region
+	return json.Marshal(fields)
+}
+
+func (m legacyGameStart) MarshalProto() ([]byte, error) {
+	return GameStart(m).MarshalProto()
+}
+
+func (m legacyGameStart) ForVersion(version int) Message {
+	return GameStart(m).ForVersion(version)
+}
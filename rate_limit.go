@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+
+	"imps/mpserver/protocol"
+)
+
+// rateLimit is a token bucket: a session can send Burst messages of an opcode
+// at once, and earns PerSecond more every second up to Burst again.
+type rateLimit struct {
+	Burst     float64
+	PerSecond float64
+}
+
+// Every opcode clients may send has a limit of its own. These are the
+// defaults, which LOBBY_RATE_LIMITS can override per opcode.
+var defaultOpcodeRateLimits = map[int64]rateLimit{
+	protocol.OP_READY:          {Burst: 3, PerSecond: 1},
+	protocol.OP_REGION_LATENCY: {Burst: 3, PerSecond: 0.5},
+	protocol.OP_RESYNC_REQUEST: {Burst: 3, PerSecond: 0.5},
+	protocol.OP_CHAT_SEND:      {Burst: 5, PerSecond: 1},
+	protocol.OP_CHAT_MUTE:      {Burst: 5, PerSecond: 1},
+	protocol.OP_LOBBY_SETTINGS: {Burst: 3, PerSecond: 0.5},
+}
+
+// Applies to opcodes without a limit of their own, which the lobby doesn't
+// handle. They all share one bucket under defaultRateLimitKey, so sending a
+// new opcode each time doesn't start over with a full bucket.
+var defaultRateLimit = rateLimit{Burst: 5, PerSecond: 2}
+
+// Opcodes start at 1, so this never collides with a real one
+const defaultRateLimitKey = 0
+
+// Dropped messages a session can rack up before it is warned and then kicked.
+// The count starts over once a session has gone a while without any drops.
+const rateLimitWarnAfter = 5
+const rateLimitKickAfter = 20
+const rateLimitForgiveSeconds = 30
+
+// tokenBucket tracks one session's allowance for one opcode. It refills by
+// match tick rather than wall clock time, so it behaves the same however
+// late a tick runs.
+type tokenBucket struct {
+	Tokens   float64
+	LastTick int64
+}
+
+func (b *tokenBucket) take(limit rateLimit, tick int64, tickRate int) bool {
+	b.Tokens += float64(tick-b.LastTick) * limit.PerSecond / float64(tickRate)
+	if b.Tokens > limit.Burst {
+		b.Tokens = limit.Burst
+	}
+	b.LastTick = tick
+
+	if b.Tokens < 1 {
+		return false
+	}
+	b.Tokens--
+	return true
+}
+
+// allowMessage charges a message against its sender's bucket for the opcode
+// and reports whether it should be processed. Opcodes the lobby doesn't handle
+// are charged to the shared default bucket and then rejected. Senders who keep
+// going over their limits are warned, then kicked. Messages from sessions
+// that aren't in the lobby are let through for the handlers to reject.
+func allowMessage(logger runtime.Logger, state *LobbyMatchState, dispatcher runtime.MatchDispatcher, message runtime.MatchData, tick int64, config *LobbyConfig) bool {
+	player, ok := state.Players[message.GetSessionId()]
+	if !ok {
+		return true
+	}
+
+	opCode := message.GetOpCode()
+	limit, known := config.RateLimits[opCode]
+	key := opCode
+	if !known {
+		limit, key = defaultRateLimit, defaultRateLimitKey
+	}
+	bucket, ok := player.RateLimits[key]
+	if !ok {
+		bucket = &tokenBucket{Tokens: limit.Burst, LastTick: tick}
+		player.RateLimits[key] = bucket
+	}
+	if bucket.take(limit, tick, config.TickRate) {
+		if !known {
+			logger.Warn("rejecting unknown opcode %d from session %s in match %s", opCode, message.GetSessionId(), state.MatchId)
+			sendError(logger, state, dispatcher, []runtime.Presence{message}, protocol.ErrorCodeBadMessage, fmt.Sprintf("Unknown opcode %d", opCode))
+		}
+		return known
+	}
+
+	if tick-player.LastViolationTick > int64(config.TickRate*rateLimitForgiveSeconds) {
+		player.Violations = 0
+	}
+	player.Violations++
+	player.LastViolationTick = tick
+
+	logger.Warn("dropped message with opcode %d from session %s in match %s, %d dropped so far",
+		opCode, message.GetSessionId(), state.MatchId, player.Violations)
+
+	switch {
+	case player.Violations == rateLimitWarnAfter:
+		logger.Warn("warning session %s in match %s for sending too many messages", message.GetSessionId(), state.MatchId)
+		sendError(logger, state, dispatcher, []runtime.Presence{message}, protocol.ErrorCodeRateLimited,
+			"You are sending messages too quickly and will be removed from the lobby if you continue")
+	case player.Violations >= rateLimitKickAfter:
+		// Kicks again for every drop after, in case the first didn't take
+		logger.Warn("kicking session %s from match %s for sending too many messages", message.GetSessionId(), state.MatchId)
+		if err := dispatcher.MatchKick([]runtime.Presence{message}); err != nil {
+			logger.Error("unable to kick session %s from match %s: %v", message.GetSessionId(), state.MatchId, err)
+		}
+	}
+
+	return false
+}
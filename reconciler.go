@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const reconcilerTickRate int = 1
+const reconcileIntervalTicks int = reconcilerTickRate * 60 // reconcilerTickRate * seconds
+
+// Allocations younger than this may belong to a lobby that is still starting
+// up, so they are never treated as orphans.
+const orphanThreshold = 5 * time.Minute
+
+const reconcilerMatchListLimit = 10000
+
+const reconcilerLabel = `{"type":"reconciler"}`
+
+// ReconcilerMatch is a system match that periodically releases game servers
+// that no running lobby owns anymore, such as ones left behind by a crash.
+type ReconcilerMatch struct {
+	allocator *ServerAllocator
+}
+
+type ReconcilerState struct {
+	TicksUntilReconcile int
+}
+
+// startReconciler creates the reconciler match unless one is already running.
+func startReconciler(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule) error {
+	existing, err := nk.MatchList(ctx, 1, true, reconcilerLabel, nil, nil, "")
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		logger.Info("reconciler already running as match %s", existing[0].MatchId)
+		return nil
+	}
+
+	matchId, err := nk.MatchCreate(ctx, "AllocationReconciler", map[string]interface{}{})
+	if err != nil {
+		return err
+	}
+	logger.Info("started reconciler as match %s", matchId)
+	return nil
+}
+
+func (r *ReconcilerMatch) reconcile(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule) {
+	matches, err := nk.MatchList(ctx, reconcilerMatchListLimit, true, "", nil, nil, "")
+	if err != nil {
+		logger.Error("unable to list matches, skipping reconcile: %v", err)
+		return
+	}
+
+	activeMatchIds := make(map[string]bool)
+	for _, match := range matches {
+		activeMatchIds[match.MatchId] = true
+	}
+
+	for _, allocation := range r.allocator.ListAllocations(logger) {
+		if activeMatchIds[allocation.MatchId] || time.Since(allocation.CreatedAt) < orphanThreshold {
+			continue
+		}
+		// Recovered lobbies run under a new match ID
+		if activeMatchIds[resolveMatchId(ctx, logger, nk, allocation.MatchId)] {
+			continue
+		}
+
+		logger.Warn("releasing orphaned game server %s on %s for match %s, allocated at %v",
+			allocation.ServerId, allocation.Backend, allocation.MatchId, allocation.CreatedAt)
+		nk.MetricsCounterAdd("lobby_orphaned_game_servers", map[string]string{"backend": allocation.Backend}, 1)
+		r.allocator.ReleaseInBackground(logger, allocation.Backend, allocation.ServerId)
+	}
+}
+
+func (r *ReconcilerMatch) MatchInit(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, params map[string]interface{}) (interface{}, int, string) {
+	// Give lobbies from before a restart a chance to come back before the first pass
+	state := &ReconcilerState{
+		TicksUntilReconcile: reconcileIntervalTicks,
+	}
+	return state, reconcilerTickRate, reconcilerLabel
+}
+
+func (r *ReconcilerMatch) MatchJoinAttempt(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, dispatcher runtime.MatchDispatcher, tick int64, state interface{}, presence runtime.Presence, metadata map[string]string) (interface{}, bool, string) {
+	return state, false, "Not joinable"
+}
+
+func (r *ReconcilerMatch) MatchJoin(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, dispatcher runtime.MatchDispatcher, tick int64, state interface{}, presences []runtime.Presence) interface{} {
+	return state
+}
+
+func (r *ReconcilerMatch) MatchLeave(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, dispatcher runtime.MatchDispatcher, tick int64, state interface{}, presences []runtime.Presence) interface{} {
+	return state
+}
+
+func (r *ReconcilerMatch) MatchLoop(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, dispatcher runtime.MatchDispatcher, tick int64, stateInterface interface{}, messages []runtime.MatchData) interface{} {
+	state, ok := stateInterface.(*ReconcilerState)
+	if !ok {
+		logger.Error("ending reconciler with invalid state of type %T", stateInterface)
+		return nil
+	}
+
+	state.TicksUntilReconcile--
+	if state.TicksUntilReconcile <= 0 {
+		r.reconcile(ctx, logger, nk)
+		state.TicksUntilReconcile = reconcileIntervalTicks
+	}
+
+	return state
+}
+
+func (r *ReconcilerMatch) MatchTerminate(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, dispatcher runtime.MatchDispatcher, tick int64, state interface{}, graceSeconds int) interface{} {
+	return state
+}
+
+func (r *ReconcilerMatch) MatchSignal(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, dispatcher runtime.MatchDispatcher, tick int64, state interface{}, data string) (interface{}, string) {
+	return state, data
+}
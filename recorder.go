@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/heroiclabs/nakama-common/api"
+	"github.com/heroiclabs/nakama-common/runtime"
+
+	"imps/mpserver/protocol"
+)
+
+// A recording is a JSON lines file with one recordedEvent per match callback,
+// written to LOBBY_RECORD_DIR/<match id>.jsonl. Each event has the callback's
+// inputs, the answers to every call the lobby made outside itself, and what
+// the lobby did: its broadcasts, label updates, kicks and resulting state.
+// Lobbies only depend on those, so a recording can be run again against newer
+// code and compared, see replay_test.go.
+
+// Callbacks
+const (
+	recordInit        = "init"
+	recordJoinAttempt = "joinAttempt"
+	recordJoin        = "join"
+	recordLeave       = "leave"
+	recordLoop        = "loop"
+	recordSignal      = "signal"
+	recordTerminate   = "terminate"
+)
+
+// Calls the lobby makes outside itself
+const (
+	callUsersGetId  = "usersGetId"
+	callFriendsList = "friendsList"
+	callEnqueue     = "enqueue"
+	callDequeue     = "dequeue"
+	callHasCapacity = "hasCapacity"
+	callAllocate    = "allocate"
+	callRelease     = "release"
+)
+
+type recordedPresence struct {
+	UserId    string `json:"userId"`
+	SessionId string `json:"sessionId"`
+	Username  string `json:"username"`
+	NodeId    string `json:"nodeId"`
+}
+
+type recordedMessage struct {
+	Presence    recordedPresence `json:"presence"`
+	OpCode      int64            `json:"opCode"`
+	Data        []byte           `json:"data"`
+	ReceiveTime int64            `json:"receiveTime"`
+}
+
+type recordedBroadcast struct {
+	OpCode int64  `json:"opCode"`
+	Data   []byte `json:"data"`
+	// Sorted session IDs, or nil when it went to everyone in the match
+	Recipients []string `json:"recipients,omitempty"`
+	Deferred   bool     `json:"deferred,omitempty"`
+}
+
+type recordedCall struct {
+	Kind   string          `json:"kind"`
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+type recordedUsers struct {
+	Users []*api.User `json:"users"`
+	Error string      `json:"error,omitempty"`
+}
+
+type recordedFriends struct {
+	Friends []*api.Friend `json:"friends"`
+	Cursor  string        `json:"cursor,omitempty"`
+	Error   string        `json:"error,omitempty"`
+}
+
+type recordedAllocation struct {
+	Allocation *gameServerAllocation `json:"allocation,omitempty"`
+	Error      string                `json:"error,omitempty"`
+	// The error was errCapacityExhausted, which the lobby checks for
+	Exhausted bool `json:"exhausted,omitempty"`
+}
+
+type recordedEvent struct {
+	Kind string `json:"kind"`
+	Tick int64  `json:"tick"`
+
+	// Only set on init, since they can change while the server runs
+	MatchId   string                 `json:"matchId,omitempty"`
+	Config    *LobbyConfig           `json:"config,omitempty"`
+	GameModes *gameModeCatalog       `json:"gameModes,omitempty"`
+	Params    map[string]interface{} `json:"params,omitempty"`
+
+	Presences []recordedPresence `json:"presences,omitempty"`
+	Metadata  map[string]string  `json:"metadata,omitempty"`
+	Messages  []recordedMessage  `json:"messages,omitempty"`
+	Signal    string             `json:"signal,omitempty"`
+	// Only set on terminate
+	GraceSeconds int            `json:"graceSeconds,omitempty"`
+	Calls        []recordedCall `json:"calls,omitempty"`
+
+	Broadcasts []recordedBroadcast `json:"broadcasts,omitempty"`
+	Labels     []string            `json:"labels,omitempty"`
+	Kicked     []string            `json:"kicked,omitempty"`
+	// Returned by the callback, depending on its kind
+	Accepted     bool   `json:"accepted,omitempty"`
+	Reason       string `json:"reason,omitempty"`
+	TickRate     int    `json:"tickRate,omitempty"`
+	Label        string `json:"label,omitempty"`
+	SignalResult string `json:"signalResult,omitempty"`
+	// nil once the lobby has ended
+	State json.RawMessage `json:"state"`
+}
+
+func recordPresence(p runtime.Presence) recordedPresence {
+	return recordedPresence{
+		UserId:    p.GetUserId(),
+		SessionId: p.GetSessionId(),
+		Username:  p.GetUsername(),
+		NodeId:    p.GetNodeId(),
+	}
+}
+
+func recordPresences(presences []runtime.Presence) []recordedPresence {
+	recorded := make([]recordedPresence, 0, len(presences))
+	for _, p := range presences {
+		recorded = append(recorded, recordPresence(p))
+	}
+	return recorded
+}
+
+// sessionIds returns the presences' session IDs in order, so recordings don't
+// depend on map iteration order. nil stays nil, since it means everyone.
+func sessionIds(presences []runtime.Presence) []string {
+	if presences == nil {
+		return nil
+	}
+	ids := make([]string, 0, len(presences))
+	for _, p := range presences {
+		ids = append(ids, p.GetSessionId())
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// matchRecorder is a LobbyMatch that records itself. InitModule registers it
+// in place of LobbyMatch when LOBBY_RECORD_DIR is set. Recording is best
+// effort: if the file can't be written the lobby carries on unrecorded.
+type matchRecorder struct {
+	match *LobbyMatch
+	dir   string
+	file  *os.File
+	// The callback being recorded, nil when not recording
+	event *recordedEvent
+}
+
+var _ runtime.Match = (*matchRecorder)(nil)
+
+func newMatchRecorder(config *LobbyConfig, allocator lobbyAllocator, queue lobbyQueue, metrics *lobbyMetrics, analytics *lobbyAnalytics) *matchRecorder {
+	r := &matchRecorder{dir: config.RecordDir}
+	r.match = &LobbyMatch{
+		config:    config,
+		allocator: &recordingAllocator{allocator, r},
+		queue:     &recordingQueue{queue, r},
+		metrics:   metrics,
+		analytics: analytics,
+	}
+	return r
+}
+
+// begin starts recording a callback, returning the dispatcher and module the
+// lobby should use so everything it does is captured.
+func (r *matchRecorder) begin(event *recordedEvent, dispatcher runtime.MatchDispatcher, nk runtime.NakamaModule) (runtime.MatchDispatcher, runtime.NakamaModule) {
+	if r.file == nil {
+		return dispatcher, nk
+	}
+	r.event = event
+	if dispatcher != nil {
+		dispatcher = &recordingDispatcher{dispatcher, r}
+	}
+	return dispatcher, &recordingNakama{nk, r}
+}
+
+// finish writes out the callback once the lobby is done with it. The file is
+// closed once the lobby ends. Lobbies keep running through the grace period
+// after MatchTerminate, so that doesn't close it.
+func (r *matchRecorder) finish(logger runtime.Logger, state interface{}) {
+	event := r.event
+	r.event = nil
+	if event == nil {
+		return
+	}
+
+	if state != nil {
+		bytes, err := json.Marshal(state)
+		if err != nil {
+			logger.Warn("unable to record lobby state: %v", err)
+		}
+		event.State = bytes
+	}
+
+	line, err := json.Marshal(event)
+	if err == nil {
+		_, err = r.file.Write(append(line, '\n'))
+	}
+	if err != nil {
+		logger.Warn("unable to record lobby, recording stopped: %v", err)
+		state = nil
+	}
+	if state == nil {
+		r.file.Close()
+		r.file = nil
+	}
+}
+
+// call records a call the lobby made outside itself.
+func (r *matchRecorder) call(kind string, result interface{}) {
+	if r.event == nil {
+		return
+	}
+	call := recordedCall{Kind: kind}
+	if result != nil {
+		call.Result, _ = json.Marshal(result)
+	}
+	r.event.Calls = append(r.event.Calls, call)
+}
+
+func (r *matchRecorder) MatchInit(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, params map[string]interface{}) (interface{}, int, string) {
+	matchId, _ := ctx.Value(runtime.RUNTIME_CTX_MATCH_ID).(string)
+
+	path := filepath.Join(r.dir, matchId+".jsonl")
+	err := os.MkdirAll(r.dir, 0755)
+	if err == nil {
+		r.file, err = os.Create(path)
+	}
+	if err != nil {
+		logger.Warn("unable to record match %s to %s: %v", matchId, path, err)
+	}
+
+	event := &recordedEvent{
+		Kind:      recordInit,
+		MatchId:   matchId,
+		Config:    r.match.config,
+		GameModes: currentGameModes(),
+		Params:    params,
+	}
+	_, nk = r.begin(event, nil, nk)
+	state, tickRate, label := r.match.MatchInit(ctx, logger, db, nk, params)
+	event.TickRate, event.Label = tickRate, label
+	r.finish(logger, state)
+	return state, tickRate, label
+}
+
+func (r *matchRecorder) MatchJoinAttempt(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, dispatcher runtime.MatchDispatcher, tick int64, state interface{}, presence runtime.Presence, metadata map[string]string) (interface{}, bool, string) {
+	event := &recordedEvent{
+		Kind:      recordJoinAttempt,
+		Tick:      tick,
+		Presences: []recordedPresence{recordPresence(presence)},
+		Metadata:  metadata,
+	}
+	dispatcher, nk = r.begin(event, dispatcher, nk)
+	state, accepted, reason := r.match.MatchJoinAttempt(ctx, logger, db, nk, dispatcher, tick, state, presence, metadata)
+	event.Accepted, event.Reason = accepted, reason
+	r.finish(logger, state)
+	return state, accepted, reason
+}
+
+func (r *matchRecorder) MatchJoin(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, dispatcher runtime.MatchDispatcher, tick int64, state interface{}, presences []runtime.Presence) interface{} {
+	event := &recordedEvent{Kind: recordJoin, Tick: tick, Presences: recordPresences(presences)}
+	dispatcher, nk = r.begin(event, dispatcher, nk)
+	state = r.match.MatchJoin(ctx, logger, db, nk, dispatcher, tick, state, presences)
+	r.finish(logger, state)
+	return state
+}
+
+func (r *matchRecorder) MatchLeave(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, dispatcher runtime.MatchDispatcher, tick int64, state interface{}, presences []runtime.Presence) interface{} {
+	event := &recordedEvent{Kind: recordLeave, Tick: tick, Presences: recordPresences(presences)}
+	dispatcher, nk = r.begin(event, dispatcher, nk)
+	state = r.match.MatchLeave(ctx, logger, db, nk, dispatcher, tick, state, presences)
+	r.finish(logger, state)
+	return state
+}
+
+func (r *matchRecorder) MatchLoop(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, dispatcher runtime.MatchDispatcher, tick int64, state interface{}, messages []runtime.MatchData) interface{} {
+	event := &recordedEvent{Kind: recordLoop, Tick: tick}
+	for _, m := range messages {
+		event.Messages = append(event.Messages, recordedMessage{
+			Presence:    recordPresence(m),
+			OpCode:      m.GetOpCode(),
+			Data:        m.GetData(),
+			ReceiveTime: m.GetReceiveTime(),
+		})
+	}
+	dispatcher, nk = r.begin(event, dispatcher, nk)
+	state = r.match.MatchLoop(ctx, logger, db, nk, dispatcher, tick, state, messages)
+	r.finish(logger, state)
+	return state
+}
+
+func (r *matchRecorder) MatchTerminate(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, dispatcher runtime.MatchDispatcher, tick int64, state interface{}, graceSeconds int) interface{} {
+	event := &recordedEvent{Kind: recordTerminate, Tick: tick, GraceSeconds: graceSeconds}
+	dispatcher, nk = r.begin(event, dispatcher, nk)
+	state = r.match.MatchTerminate(ctx, logger, db, nk, dispatcher, tick, state, graceSeconds)
+	r.finish(logger, state)
+	return state
+}
+
+func (r *matchRecorder) MatchSignal(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, dispatcher runtime.MatchDispatcher, tick int64, state interface{}, data string) (interface{}, string) {
+	event := &recordedEvent{Kind: recordSignal, Tick: tick, Signal: data}
+	dispatcher, nk = r.begin(event, dispatcher, nk)
+	state, result := r.match.MatchSignal(ctx, logger, db, nk, dispatcher, tick, state, data)
+	event.SignalResult = result
+	r.finish(logger, state)
+	return state, result
+}
+
+// recordingDispatcher passes everything on to Nakama's dispatcher, recording
+// it on the way.
+type recordingDispatcher struct {
+	runtime.MatchDispatcher
+	recorder *matchRecorder
+}
+
+func (d *recordingDispatcher) BroadcastMessage(opCode int64, data []byte, presences []runtime.Presence, sender runtime.Presence, reliable bool) error {
+	d.record(opCode, data, presences, false)
+	return d.MatchDispatcher.BroadcastMessage(opCode, data, presences, sender, reliable)
+}
+
+func (d *recordingDispatcher) BroadcastMessageDeferred(opCode int64, data []byte, presences []runtime.Presence, sender runtime.Presence, reliable bool) error {
+	d.record(opCode, data, presences, true)
+	return d.MatchDispatcher.BroadcastMessageDeferred(opCode, data, presences, sender, reliable)
+}
+
+func (d *recordingDispatcher) record(opCode int64, data []byte, presences []runtime.Presence, deferred bool) {
+	if event := d.recorder.event; event != nil {
+		event.Broadcasts = append(event.Broadcasts, recordedBroadcast{
+			OpCode:     opCode,
+			Data:       data,
+			Recipients: sessionIds(presences),
+			Deferred:   deferred,
+		})
+	}
+}
+
+func (d *recordingDispatcher) MatchKick(presences []runtime.Presence) error {
+	if event := d.recorder.event; event != nil {
+		event.Kicked = append(event.Kicked, sessionIds(presences)...)
+	}
+	return d.MatchDispatcher.MatchKick(presences)
+}
+
+func (d *recordingDispatcher) MatchLabelUpdate(label string) error {
+	if event := d.recorder.event; event != nil {
+		event.Labels = append(event.Labels, label)
+	}
+	return d.MatchDispatcher.MatchLabelUpdate(label)
+}
+
+// recordingNakama records the answers to the lookups lobbies make when
+// players join.
+type recordingNakama struct {
+	runtime.NakamaModule
+	recorder *matchRecorder
+}
+
+func (n *recordingNakama) UsersGetId(ctx context.Context, userIDs []string, facebookIDs []string) ([]*api.User, error) {
+	users, err := n.NakamaModule.UsersGetId(ctx, userIDs, facebookIDs)
+	n.recorder.call(callUsersGetId, recordedUsers{users, errorString(err)})
+	return users, err
+}
+
+func (n *recordingNakama) FriendsList(ctx context.Context, userID string, limit int, state *int, cursor string) ([]*api.Friend, string, error) {
+	friends, next, err := n.NakamaModule.FriendsList(ctx, userID, limit, state, cursor)
+	n.recorder.call(callFriendsList, recordedFriends{friends, next, errorString(err)})
+	return friends, next, err
+}
+
+type recordingAllocator struct {
+	allocator lobbyAllocator
+	recorder  *matchRecorder
+}
+
+func (a *recordingAllocator) Allocate(matchId string, region string, settings protocol.LobbySettings) (*gameServerAllocation, error) {
+	server, err := a.allocator.Allocate(matchId, region, settings)
+	a.recorder.call(callAllocate, recordedAllocation{server, errorString(err), errors.Is(err, errCapacityExhausted)})
+	return server, err
+}
+
+func (a *recordingAllocator) HasCapacity() bool {
+	ok := a.allocator.HasCapacity()
+	a.recorder.call(callHasCapacity, ok)
+	return ok
+}
+
+func (a *recordingAllocator) ReleaseInBackground(logger runtime.Logger, backend string, serverId string) {
+	a.recorder.call(callRelease, nil)
+	a.allocator.ReleaseInBackground(logger, backend, serverId)
+}
+
+type recordingQueue struct {
+	queue    lobbyQueue
+	recorder *matchRecorder
+}
+
+func (q *recordingQueue) Enqueue(matchId string) int {
+	position := q.queue.Enqueue(matchId)
+	q.recorder.call(callEnqueue, position)
+	return position
+}
+
+func (q *recordingQueue) Remove(matchId string) {
+	q.recorder.call(callDequeue, nil)
+	q.queue.Remove(matchId)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strings"
+
+	"imps/mpserver/protocol"
+)
+
+const latencyMetadataKey = "latencies"
+
+// Anything slower than this isn't a measurement worth trusting
+const maxReportedLatency = 60000
+
+func validateLatencies(regions []string, r *protocol.RegionLatency) error {
+	var errs fieldErrors
+	reported := make([]string, 0, len(r.Latencies))
+	for region := range r.Latencies {
+		reported = append(reported, region)
+	}
+	sort.Strings(reported)
+
+	for _, region := range reported {
+		rtt := r.Latencies[region]
+		field := "latencies." + region
+		if !contains(regions, region) {
+			errs.add(field, "must be one of %s", strings.Join(regions, ", "))
+		}
+		if rtt < 0 || rtt > maxReportedLatency {
+			errs.add(field, "must be between 0 and %d", maxReportedLatency)
+		}
+	}
+
+	if len(errs) > 0 {
+		return &validationError{errs}
+	}
+	return nil
+}
+
+// parseLatencies decodes a JSON map of region name to round trip time in
+// milliseconds, as sent in join metadata.
+func parseLatencies(regions []string, data []byte) (map[string]int, error) {
+	var report protocol.RegionLatency
+	if err := decodePayload(data, &report); err != nil {
+		return nil, err
+	}
+	return checkLatencies(regions, &report)
+}
+
+// readLatencyReport decodes an OP_REGION_LATENCY payload from a player.
+func readLatencyReport(regions []string, player *PlayerState, data []byte) (map[string]int, error) {
+	var report protocol.RegionLatency
+	if err := decodeMessage(player, data, &report); err != nil {
+		return nil, err
+	}
+	return checkLatencies(regions, &report)
+}
+
+// checkLatencies validates a decoded latency report, returning its latencies.
+func checkLatencies(regions []string, report *protocol.RegionLatency) (map[string]int, error) {
+	if err := validateLatencies(regions, report); err != nil {
+		return nil, err
+	}
+
+	if report.Latencies == nil {
+		return make(map[string]int), nil
+	}
+	return report.Latencies, nil
+}
+
+// selectRegion picks the region that minimizes the worst latency among the
+// given players. A player that hasn't reported a region counts as unreachable
+// there, and ties go to whichever region is configured first.
+func selectRegion(regions []string, players []*PlayerState) string {
+	bestRegion := regions[0]
+	bestWorst := math.MaxInt
+
+	for _, region := range regions {
+		worst := 0
+		for _, p := range players {
+			rtt, ok := p.Latencies[region]
+			if !ok {
+				rtt = math.MaxInt
+			}
+			if rtt > worst {
+				worst = rtt
+			}
+		}
+
+		if worst < bestWorst {
+			bestRegion = region
+			bestWorst = worst
+		}
+	}
+
+	return bestRegion
+}
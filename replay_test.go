@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/heroiclabs/nakama-common/api"
+	"github.com/heroiclabs/nakama-common/runtime"
+
+	"imps/mpserver/nakamatest"
+	"imps/mpserver/protocol"
+)
+
+// Replaying a recording from a server, see recorder.go:
+//
+//	go test -run TestReplay -replay /path/to/recordings
+var replayPath = flag.String("replay", "", "replay the lobby recording at this path, or every .jsonl file in this directory")
+
+func TestReplay(t *testing.T) {
+	if *replayPath == "" {
+		t.Skip("no recording given with -replay")
+	}
+
+	paths := []string{*replayPath}
+	if info, err := os.Stat(*replayPath); err == nil && info.IsDir() {
+		paths, _ = filepath.Glob(filepath.Join(*replayPath, "*.jsonl"))
+	}
+	for _, path := range paths {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			for _, diff := range replayRecording(t, path) {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	dir := t.TempDir()
+	h := newLobbyHarness(t, map[string]string{envChatFilter: "darn"})
+	h.record(dir)
+	h.init("host", protocol.LobbySettings{})
+	host := h.nk.AddUser("host", "Host")
+	guest := h.nk.AddUser("guest", "Guest")
+	h.nk.Blocked["guest"] = []string{"host"}
+
+	h.join(host, deltaClient)
+	h.join(guest, map[string]string{latencyMetadataKey: `{"latencies":{"eu-west":40}}`})
+	h.loop(message(host, protocol.OP_CHAT_SEND, protocol.ChatSend{Text: "darn it"}))
+	h.loop(message(host, protocol.OP_READY, nil), message(guest, protocol.OP_READY, nil))
+	h.loop()
+	h.leave(guest)
+	h.match.MatchSignal(h.ctx, h.logger, nil, h.nk, h.dispatcher, h.tick, h.state, signalGameEnded)
+	h.terminate(30)
+
+	path := filepath.Join(dir, "lobby.node.jsonl")
+	events, err := readRecording(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 11 {
+		t.Fatalf("recorded %d events, want 11", len(events))
+	}
+	if calls := events[6].Calls; len(calls) < 2 || calls[1].Kind != callAllocate {
+		t.Fatalf("readying up made calls %+v, want a game server allocated", calls)
+	}
+
+	if diffs := replayRecording(t, path); len(diffs) > 0 {
+		t.Fatalf("replay differs from the recording:\n%s", strings.Join(diffs, "\n"))
+	}
+
+	// Replaying has to notice when the code no longer does what it did
+	events[5].Broadcasts[0].Data = []byte(`{"text":"something else"}`)
+	events[6].Calls = events[6].Calls[1:]
+	tampered := filepath.Join(dir, "tampered.jsonl")
+	writeRecording(t, tampered, events)
+
+	diffs := replayRecording(t, tampered)
+	for _, want := range []string{"event 5 (loop at tick 1): broadcasts[0].data", "event 6 (loop at tick 2): made a enqueue call where the recording has allocate"} {
+		found := false
+		for _, diff := range diffs {
+			found = found || strings.Contains(diff, want)
+		}
+		if !found {
+			t.Errorf("replay of a tampered recording doesn't report %q, got:\n%s", want, strings.Join(diffs, "\n"))
+		}
+	}
+}
+
+func readRecording(path string) ([]*recordedEvent, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	events := make([]*recordedEvent, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		var event recordedEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", path, len(events)+1, err)
+		}
+		events = append(events, &event)
+	}
+	return events, scanner.Err()
+}
+
+func writeRecording(t *testing.T, path string, events []*recordedEvent) {
+	t.Helper()
+
+	lines := make([]string, 0, len(events))
+	for _, e := range events {
+		line, err := json.Marshal(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, string(line))
+	}
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// replayRecording runs a recording against the current LobbyMatch, answering
+// its outside calls from the recording, and returns every way the result
+// differs from what was recorded.
+func replayRecording(t *testing.T, path string) []string {
+	t.Helper()
+
+	events, err := readRecording(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) == 0 || events[0].Kind != recordInit || events[0].Config == nil || events[0].GameModes == nil {
+		t.Fatalf("%s doesn't start with a recorded init", path)
+	}
+	init := events[0]
+
+	config := *init.Config
+	config.chatFilter = newWordFilter(config.ChatFilter)
+	r := &replayer{}
+	nk := &replayNakama{nakamatest.NewNakamaModule(), r}
+	match := &LobbyMatch{config: &config, allocator: &replayAllocator{r}, queue: &replayQueue{r}, metrics: newLobbyMetrics(nk), analytics: newLobbyAnalytics(nk)}
+	ctx := context.WithValue(context.Background(), runtime.RUNTIME_CTX_MATCH_ID, init.MatchId)
+	logger := nakamatest.NewLogger(t)
+
+	// The catalog the lobby was created with, loaded the way the server does
+	catalog, _ := json.Marshal(init.GameModes)
+	nk.Storage[gameModesCollection+"/"+gameModesKey+"/"+systemUserId] = &api.StorageObject{Value: string(catalog)}
+	if err := reloadGameModes(ctx, logger, nk, ""); err != nil {
+		t.Fatalf("loading recorded game modes: %v", err)
+	}
+
+	var state interface{}
+	for i, e := range events {
+		r.start(fmt.Sprintf("event %d (%s at tick %d)", i, e.Kind, e.Tick), e.Calls)
+		dispatcher := &nakamatest.Dispatcher{}
+		replayed := &recordedEvent{Kind: e.Kind, Tick: e.Tick}
+
+		presences := make([]runtime.Presence, 0, len(e.Presences))
+		for _, p := range e.Presences {
+			presences = append(presences, replayPresence(p))
+		}
+
+		switch e.Kind {
+		case recordInit:
+			state, replayed.TickRate, replayed.Label = match.MatchInit(ctx, logger, nil, nk, e.Params)
+		case recordJoinAttempt:
+			if len(presences) != 1 {
+				t.Fatalf("%s: join attempt with %d presences", r.event, len(presences))
+			}
+			state, replayed.Accepted, replayed.Reason = match.MatchJoinAttempt(ctx, logger, nil, nk, dispatcher, e.Tick, state, presences[0], e.Metadata)
+		case recordJoin:
+			state = match.MatchJoin(ctx, logger, nil, nk, dispatcher, e.Tick, state, presences)
+		case recordLeave:
+			state = match.MatchLeave(ctx, logger, nil, nk, dispatcher, e.Tick, state, presences)
+		case recordLoop:
+			messages := make([]runtime.MatchData, 0, len(e.Messages))
+			for _, m := range e.Messages {
+				messages = append(messages, &nakamatest.MatchData{
+					Presence:    replayPresence(m.Presence),
+					OpCode:      m.OpCode,
+					Data:        m.Data,
+					ReceiveTime: m.ReceiveTime,
+				})
+			}
+			state = match.MatchLoop(ctx, logger, nil, nk, dispatcher, e.Tick, state, messages)
+		case recordSignal:
+			state, replayed.SignalResult = match.MatchSignal(ctx, logger, nil, nk, dispatcher, e.Tick, state, e.Signal)
+		case recordTerminate:
+			state = match.MatchTerminate(ctx, logger, nil, nk, dispatcher, e.Tick, state, e.GraceSeconds)
+		default:
+			t.Fatalf("%s: unknown kind of event", r.event)
+		}
+
+		for _, b := range dispatcher.Broadcasts {
+			replayed.Broadcasts = append(replayed.Broadcasts, recordedBroadcast{
+				OpCode:     b.OpCode,
+				Data:       b.Data,
+				Recipients: sessionIds(b.Presences),
+				Deferred:   b.Deferred,
+			})
+		}
+		replayed.Labels = dispatcher.Labels
+		replayed.Kicked = sessionIds(dispatcher.Kicked)
+		if state != nil {
+			replayed.State, _ = json.Marshal(state)
+		}
+
+		r.finish()
+		for _, diff := range diffJSON("", eventOutcome(e), eventOutcome(replayed)) {
+			r.diffs = append(r.diffs, r.event+": "+diff)
+		}
+		if state == nil {
+			if i != len(events)-1 {
+				r.diffs = append(r.diffs, fmt.Sprintf("%s: lobby ended, recording has %d more events", r.event, len(events)-1-i))
+			}
+			break
+		}
+	}
+	return r.diffs
+}
+
+func replayPresence(p recordedPresence) *nakamatest.Presence {
+	return &nakamatest.Presence{UserId: p.UserId, SessionId: p.SessionId, Username: p.Username, NodeId: p.NodeId}
+}
+
+// eventOutcome is what an event's lobby did, as plain JSON values so it can
+// be compared with diffJSON. Message data is decoded when it is JSON, so
+// differences are readable.
+func eventOutcome(e *recordedEvent) interface{} {
+	broadcasts := make([]interface{}, 0, len(e.Broadcasts))
+	for _, b := range e.Broadcasts {
+		var data interface{} = b.Data
+		if json.Valid(b.Data) {
+			data = json.RawMessage(b.Data)
+		}
+		broadcasts = append(broadcasts, map[string]interface{}{
+			"opCode":     b.OpCode,
+			"data":       data,
+			"recipients": b.Recipients,
+			"deferred":   b.Deferred,
+		})
+	}
+
+	bytes, _ := json.Marshal(map[string]interface{}{
+		"broadcasts":   broadcasts,
+		"labels":       e.Labels,
+		"kicked":       e.Kicked,
+		"accepted":     e.Accepted,
+		"reason":       e.Reason,
+		"tickRate":     e.TickRate,
+		"label":        e.Label,
+		"signalResult": e.SignalResult,
+		"state":        e.State,
+	})
+	var outcome interface{}
+	json.Unmarshal(bytes, &outcome)
+	return outcome
+}
+
+// diffJSON lists the paths under path where two decoded JSON values differ.
+func diffJSON(path string, recorded, replayed interface{}) []string {
+	switch a := recorded.(type) {
+	case map[string]interface{}:
+		if b, ok := replayed.(map[string]interface{}); ok {
+			keys := make([]string, 0, len(a)+len(b))
+			for k := range a {
+				keys = append(keys, k)
+			}
+			for k := range b {
+				if _, ok := a[k]; !ok {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+
+			diffs := make([]string, 0)
+			for _, k := range keys {
+				key := k
+				if path != "" {
+					key = path + "." + k
+				}
+				diffs = append(diffs, diffJSON(key, a[k], b[k])...)
+			}
+			return diffs
+		}
+	case []interface{}:
+		if b, ok := replayed.([]interface{}); ok && len(a) == len(b) {
+			diffs := make([]string, 0)
+			for i := range a {
+				diffs = append(diffs, diffJSON(fmt.Sprintf("%s[%d]", path, i), a[i], b[i])...)
+			}
+			return diffs
+		}
+	}
+
+	if reflect.DeepEqual(recorded, replayed) {
+		return nil
+	}
+	a, _ := json.Marshal(recorded)
+	b, _ := json.Marshal(replayed)
+	return []string{fmt.Sprintf("%s: recorded %s, replayed %s", path, a, b)}
+}
+
+// replayer hands out the recorded answers to an event's outside calls, in
+// the order they were made.
+type replayer struct {
+	event string
+	calls []recordedCall
+	diffs []string
+}
+
+func (r *replayer) start(event string, calls []recordedCall) {
+	r.event = event
+	r.calls = calls
+}
+
+// next decodes the answer to the next call into result. It reports false,
+// with a diff, when the lobby made a call the recording doesn't have.
+func (r *replayer) next(kind string, result interface{}) bool {
+	if len(r.calls) == 0 {
+		r.diffs = append(r.diffs, fmt.Sprintf("%s: made a %s call the recording doesn't have", r.event, kind))
+		return false
+	}
+	call := r.calls[0]
+	r.calls = r.calls[1:]
+	if call.Kind != kind {
+		r.diffs = append(r.diffs, fmt.Sprintf("%s: made a %s call where the recording has %s", r.event, kind, call.Kind))
+		return false
+	}
+	if result != nil && call.Result != nil {
+		if err := json.Unmarshal(call.Result, result); err != nil {
+			r.diffs = append(r.diffs, fmt.Sprintf("%s: unreadable %s result: %v", r.event, kind, err))
+			return false
+		}
+	}
+	return true
+}
+
+func (r *replayer) finish() {
+	for _, call := range r.calls {
+		r.diffs = append(r.diffs, fmt.Sprintf("%s: didn't make the recorded %s call", r.event, call.Kind))
+	}
+	r.calls = nil
+}
+
+var errNotRecorded = errors.New("not in the recording")
+
+type replayNakama struct {
+	*nakamatest.NakamaModule
+	replayer *replayer
+}
+
+func (n *replayNakama) UsersGetId(ctx context.Context, userIDs []string, facebookIDs []string) ([]*api.User, error) {
+	var result recordedUsers
+	if !n.replayer.next(callUsersGetId, &result) {
+		return nil, errNotRecorded
+	}
+	if result.Error != "" {
+		return nil, errors.New(result.Error)
+	}
+	return result.Users, nil
+}
+
+func (n *replayNakama) FriendsList(ctx context.Context, userID string, limit int, state *int, cursor string) ([]*api.Friend, string, error) {
+	var result recordedFriends
+	if !n.replayer.next(callFriendsList, &result) {
+		return nil, "", errNotRecorded
+	}
+	if result.Error != "" {
+		return nil, "", errors.New(result.Error)
+	}
+	return result.Friends, result.Cursor, nil
+}
+
+type replayAllocator struct {
+	replayer *replayer
+}
+
+func (a *replayAllocator) Allocate(matchId string, region string, settings protocol.LobbySettings) (*gameServerAllocation, error) {
+	var result recordedAllocation
+	if !a.replayer.next(callAllocate, &result) {
+		return nil, errNotRecorded
+	}
+	switch {
+	case result.Exhausted:
+		return nil, errCapacityExhausted
+	case result.Error != "":
+		return nil, errors.New(result.Error)
+	}
+	return result.Allocation, nil
+}
+
+func (a *replayAllocator) HasCapacity() bool {
+	var ok bool
+	a.replayer.next(callHasCapacity, &ok)
+	return ok
+}
+
+func (a *replayAllocator) ReleaseInBackground(logger runtime.Logger, backend string, serverId string) {
+	a.replayer.next(callRelease, nil)
+}
+
+type replayQueue struct {
+	replayer *replayer
+}
+
+func (q *replayQueue) Enqueue(matchId string) int {
+	var position int
+	q.replayer.next(callEnqueue, &position)
+	return position
+}
+
+func (q *replayQueue) Remove(matchId string) {
+	q.replayer.next(callDequeue, nil)
+}
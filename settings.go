@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+
+	"imps/mpserver/protocol"
+)
+
+// withDefaults fills in whatever the settings leave out from the catalog's
+// defaults: the default mode, its first map, its default time limit and every
+// rule's default value. Unknown modes are left alone for validation to catch.
+func withDefaults(modes *gameModeCatalog, s protocol.LobbySettings) protocol.LobbySettings {
+	if s.Mode == "" {
+		s.Mode = modes.DefaultMode
+	}
+	mode, ok := modes.Modes[s.Mode]
+	if !ok {
+		return s
+	}
+
+	if s.Map == "" {
+		s.Map = mode.Maps[0]
+	}
+	if s.TimeLimit == 0 {
+		s.TimeLimit = mode.DefaultTimeLimit
+	}
+
+	rules := make(map[string]string, len(mode.Rules))
+	for name, spec := range mode.Rules {
+		rules[name] = spec.Default
+	}
+	for name, value := range s.Rules {
+		rules[name] = value
+	}
+	s.Rules = rules
+	return s
+}
+
+// validateSettings checks complete settings, as returned by withDefaults,
+// against their mode in the catalog.
+func validateSettings(errs *fieldErrors, field string, modes *gameModeCatalog, s protocol.LobbySettings) {
+	mode, ok := modes.Modes[s.Mode]
+	if !ok {
+		errs.add(field+".mode", "must be one of %s", strings.Join(modes.modeNames(), ", "))
+		return
+	}
+
+	if !contains(mode.Maps, s.Map) {
+		errs.add(field+".map", "must be one of %s", strings.Join(mode.Maps, ", "))
+	}
+	if s.TimeLimit < mode.MinTimeLimit || s.TimeLimit > mode.MaxTimeLimit {
+		errs.add(field+".timeLimit", "must be between %d and %d", mode.MinTimeLimit, mode.MaxTimeLimit)
+	}
+
+	names := make([]string, 0, len(s.Rules))
+	for name := range s.Rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		ruleField := field + ".rules." + name
+		spec, ok := mode.Rules[name]
+		if !ok {
+			errs.add(ruleField, "is not a rule of %s", s.Mode)
+			continue
+		}
+		if err := spec.check(s.Rules[name]); err != nil {
+			errs.add(ruleField, "%v", err)
+		}
+	}
+}
+
+func (r ruleSpec) check(value string) error {
+	switch r.Type {
+	case ruleTypeBool:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("must be true or false")
+		}
+	case ruleTypeInt:
+		n, err := strconv.Atoi(value)
+		if err != nil || n < r.Min || n > r.Max {
+			return fmt.Errorf("must be an integer between %d and %d", r.Min, r.Max)
+		}
+	case ruleTypeChoice:
+		if !contains(r.Choices, value) {
+			return fmt.Errorf("must be one of %s", strings.Join(r.Choices, ", "))
+		}
+	default:
+		return fmt.Errorf("has unknown rule type %q", r.Type)
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// applyGameMode sizes the lobby for its mode. Players who no longer fit in
+// the mode's player slots become observers, and the roster snapshot sent after
+// a settings change tells everyone.
+func applyGameMode(state *LobbyMatchState, mode *gameMode) {
+	state.RequiredPlayerCount = mode.PlayerCount
+	state.AllowedObservers = mode.MaxObservers
+	state.Ranked = mode.Ranked
+	updateObserverFlags(state)
+	updateWaitingState(state)
+}
+
+// settingsEditable reports whether the lobby's settings can still change,
+// which stops once it starts looking for a game server.
+func settingsEditable(state *LobbyMatchState) bool {
+	return state.GameState == WaitingForPlayers || state.GameState == WaitingForPlayersReady
+}
+
+// handleSettingsUpdate lets the host change the lobby's settings. Anyone who
+// readied up did so for the old settings, so everyone has to ready up again.
+func handleSettingsUpdate(logger runtime.Logger, state *LobbyMatchState, dispatcher runtime.MatchDispatcher, player *PlayerState, message runtime.MatchData) {
+	var update protocol.LobbySettings
+	if err := decodeMessage(player, message.GetData(), &update); err != nil {
+		logger.Warn("ignoring malformed settings from %s: %v", message.GetUserId(), err)
+		sendError(logger, state, dispatcher, []runtime.Presence{message}, protocol.ErrorCodeBadMessage, err.Error())
+		return
+	}
+
+	if player.UserId != state.HostUserId {
+		sendError(logger, state, dispatcher, []runtime.Presence{message}, protocol.ErrorCodeNotHost, "Only the host can change the lobby settings")
+		return
+	}
+	if !settingsEditable(state) {
+		sendError(logger, state, dispatcher, []runtime.Presence{message}, protocol.ErrorCodeSettingsLocked, "The game is already starting")
+		return
+	}
+
+	modes := currentGameModes()
+	settings := withDefaults(modes, update)
+	var errs fieldErrors
+	validateSettings(&errs, "settings", modes, settings)
+	if mode, ok := modes.Modes[settings.Mode]; ok && len(state.Players) > mode.PlayerCount+mode.MaxObservers {
+		errs.add("settings.mode", "only has room for %d players and observers", mode.PlayerCount+mode.MaxObservers)
+	}
+	if len(errs) > 0 {
+		err := &validationError{errs}
+		sendError(logger, state, dispatcher, []runtime.Presence{message}, protocol.ErrorCodeBadMessage, err.Error())
+		return
+	}
+
+	logger.Info("host %s changed settings of match %s to %+v", player.UserId, state.MatchId, settings)
+	state.Settings = settings
+	applyGameMode(state, modes.Modes[settings.Mode])
+	for _, p := range state.Players {
+		p.IsReady = false
+	}
+
+	updateLabel(logger, state, dispatcher)
+	broadcastLobbySnapshot(logger, state, dispatcher)
+}
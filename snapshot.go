@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+
+	"imps/mpserver/protocol"
+)
+
+// Lobbies only live in memory, so each one keeps a snapshot of itself in
+// storage. After a restart InitModule brings back the lobbies whose game was
+// in progress, so their players can rejoin and the game server can still
+// report the result. Lobbies that hadn't launched went away with their
+// players' sessions, so their snapshots are only cleaned up.
+
+const (
+	snapshotCollection = "lobby_snapshots"
+	// Snapshots from before version 2 have no participants, so lobbies
+	// can't be recovered from them safely
+	snapshotVersion   = 2
+	snapshotListLimit = 100
+)
+
+// savedLobby is the part of LobbyMatchState that outlives the players'
+// sessions. Only the users in the game are kept from the roster, so nobody
+// else can join the recovered lobby and be handed the game server. Chat and
+// rate limits start over.
+type savedLobby struct {
+	Version int `json:"version"`
+	// Unix seconds
+	SavedAt int64 `json:"savedAt"`
+	// The match the lobby is running as, which changes when it is recovered
+	MatchId string `json:"matchId"`
+	// The match the lobby was created as, which its snapshot and game server
+	// know it by
+	OriginalMatchId     string                 `json:"originalMatchId"`
+	MatchName           string                 `json:"matchName"`
+	IsPrivate           bool                   `json:"isPrivate"`
+	HostUserId          string                 `json:"hostUserId"`
+	Settings            protocol.LobbySettings `json:"settings"`
+	Ranked              bool                   `json:"ranked"`
+	RequiredPlayerCount int                    `json:"requiredPlayerCount"`
+	AllowedObservers    int                    `json:"allowedObservers"`
+	GameState           GameState              `json:"gameState"`
+	Region              string                 `json:"region,omitempty"`
+	ServerId            string                 `json:"serverId,omitempty"`
+	ServerBackend       string                 `json:"serverBackend,omitempty"`
+	ServerResponse      json.RawMessage        `json:"serverResponse,omitempty"`
+	MutedUserIds        []string               `json:"mutedUserIds,omitempty"`
+	Participants        []savedParticipant     `json:"participants"`
+}
+
+type savedParticipant struct {
+	UserId      string `json:"userId"`
+	IsObserving bool   `json:"isObserving"`
+}
+
+func newSavedLobby(state *LobbyMatchState) *savedLobby {
+	muted := make([]string, 0, len(state.MutedUserIds))
+	for userId := range state.MutedUserIds {
+		muted = append(muted, userId)
+	}
+	sort.Strings(muted)
+
+	// A recovered lobby keeps its participants who haven't rejoined yet
+	roles := make(map[string]bool, len(state.Participants))
+	for userId, observing := range state.Participants {
+		roles[userId] = observing
+	}
+	for _, p := range joinedPlayers(state) {
+		roles[p.UserId] = p.IsObserving
+	}
+	participants := make([]savedParticipant, 0, len(roles))
+	for userId, observing := range roles {
+		participants = append(participants, savedParticipant{UserId: userId, IsObserving: observing})
+	}
+	sort.Slice(participants, func(a, b int) bool {
+		return participants[a].UserId < participants[b].UserId
+	})
+
+	return &savedLobby{
+		Version:             snapshotVersion,
+		SavedAt:             time.Now().Unix(),
+		MatchId:             state.MatchId,
+		OriginalMatchId:     state.OriginalMatchId,
+		MatchName:           state.MatchName,
+		IsPrivate:           state.IsPrivate,
+		HostUserId:          state.HostUserId,
+		Settings:            state.Settings,
+		Ranked:              state.Ranked,
+		RequiredPlayerCount: state.RequiredPlayerCount,
+		AllowedObservers:    state.AllowedObservers,
+		GameState:           state.GameState,
+		Region:              state.Region,
+		ServerId:            state.ServerId,
+		ServerBackend:       state.ServerBackend,
+		ServerResponse:      state.ServerResponse,
+		MutedUserIds:        muted,
+		Participants:        participants,
+	}
+}
+
+func (s *savedLobby) validate(errs *fieldErrors) {
+	validateMatchId(errs, "recovered.originalMatchId", s.OriginalMatchId)
+	if s.GameState != InProgress {
+		errs.add("recovered.gameState", "must be %d, only games in progress are recovered", InProgress)
+	}
+	if s.ServerBackend == "" {
+		errs.add("recovered.serverBackend", "is required")
+	}
+	if s.RequiredPlayerCount < 1 {
+		errs.add("recovered.requiredPlayerCount", "must be at least 1")
+	}
+	if len(s.Participants) == 0 {
+		errs.add("recovered.participants", "must list who was in the game")
+	}
+	for i, p := range s.Participants {
+		if p.UserId == "" {
+			errs.add(fmt.Sprintf("recovered.participants[%d].userId", i), "is required")
+		}
+	}
+}
+
+// restore rebuilds the lobby as matchId, empty until its players rejoin.
+func (s *savedLobby) restore(matchId string) *LobbyMatchState {
+	muted := make(map[string]bool, len(s.MutedUserIds))
+	for _, userId := range s.MutedUserIds {
+		muted[userId] = true
+	}
+	participants := make(map[string]bool, len(s.Participants))
+	for _, p := range s.Participants {
+		participants[p.UserId] = p.IsObserving
+	}
+
+	return &LobbyMatchState{
+		Players:             make(map[string]*PlayerState),
+		RequiredPlayerCount: s.RequiredPlayerCount,
+		AllowedObservers:    s.AllowedObservers,
+		IsPrivate:           s.IsPrivate,
+		GameState:           s.GameState,
+		MatchName:           s.MatchName,
+		CanJoin:             false,
+		MatchId:             matchId,
+		OriginalMatchId:     s.OriginalMatchId,
+		Region:              s.Region,
+		ServerId:            s.ServerId,
+		ServerBackend:       s.ServerBackend,
+		ServerResponse:      s.ServerResponse,
+		HostUserId:          s.HostUserId,
+		MutedUserIds:        muted,
+		ChatHistory:         make([]protocol.ChatMessage, 0),
+		Settings:            s.Settings,
+		Ranked:              s.Ranked,
+		Recovered:           true,
+		Participants:        participants,
+	}
+}
+
+// saveSnapshot writes the lobby's snapshot. A failed write only costs the
+// lobby its chance of surviving a restart, so it is logged and otherwise
+// ignored.
+func saveSnapshot(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, state *LobbyMatchState) {
+	bytes, err := json.Marshal(newSavedLobby(state))
+	if err != nil {
+		logger.Error("unable to encode snapshot of match %s: %v", state.MatchId, err)
+		return
+	}
+
+	if _, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{{
+		Collection:      snapshotCollection,
+		Key:             state.OriginalMatchId,
+		UserID:          systemUserId,
+		Value:           string(bytes),
+		PermissionRead:  runtime.STORAGE_PERMISSION_NO_READ,
+		PermissionWrite: runtime.STORAGE_PERMISSION_NO_WRITE,
+	}}); err != nil {
+		logger.Warn("unable to save snapshot of match %s: %v", state.MatchId, err)
+	}
+}
+
+// deleteSnapshot is for lobbies that have ended for good.
+func deleteSnapshot(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, originalMatchId string) {
+	if err := nk.StorageDelete(ctx, []*runtime.StorageDelete{{
+		Collection: snapshotCollection,
+		Key:        originalMatchId,
+		UserID:     systemUserId,
+	}}); err != nil {
+		logger.Warn("unable to delete snapshot of match %s: %v", originalMatchId, err)
+	}
+}
+
+func readSnapshot(ctx context.Context, nk runtime.NakamaModule, originalMatchId string) (*savedLobby, error) {
+	objects, err := nk.StorageRead(ctx, []*runtime.StorageRead{{
+		Collection: snapshotCollection,
+		Key:        originalMatchId,
+		UserID:     systemUserId,
+	}})
+	if err != nil || len(objects) == 0 {
+		return nil, err
+	}
+
+	var snapshot savedLobby
+	if err := json.Unmarshal([]byte(objects[0].GetValue()), &snapshot); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// resolveMatchId finds the match a lobby is running as now, given the match
+// ID it was created with, which is all its game server knows.
+func resolveMatchId(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, matchId string) string {
+	snapshot, err := readSnapshot(ctx, nk, matchId)
+	if err != nil {
+		logger.Warn("unable to read snapshot of match %s: %v", matchId, err)
+	}
+	if snapshot == nil || snapshot.MatchId == "" {
+		return matchId
+	}
+	return snapshot.MatchId
+}
+
+// recoverLobbies goes through the snapshots left by lobbies that are no longer
+// running. Games that were in progress and saved within maxAge get their lobby
+// back, and everything else is deleted. Snapshots are claimed with a
+// conditional write first, so nodes starting together don't both recover the
+// same lobby.
+func recoverLobbies(ctx context.Context, logger runtime.Logger, nk runtime.NakamaModule, maxAge time.Duration) error {
+	cursor := ""
+	for {
+		objects, next, err := nk.StorageList(ctx, "", systemUserId, snapshotCollection, snapshotListLimit, cursor)
+		if err != nil {
+			return err
+		}
+
+		for _, object := range objects {
+			var snapshot savedLobby
+			if err := json.Unmarshal([]byte(object.GetValue()), &snapshot); err != nil || snapshot.Version != snapshotVersion {
+				logger.Warn("deleting unreadable lobby snapshot %s", object.GetKey())
+				deleteSnapshot(ctx, logger, nk, object.GetKey())
+				continue
+			}
+
+			if match, err := nk.MatchGet(ctx, snapshot.MatchId); err == nil && match != nil {
+				// Still running, on this node or another
+				continue
+			}
+
+			age := time.Since(time.Unix(snapshot.SavedAt, 0))
+			if snapshot.GameState != InProgress || age > maxAge {
+				logger.Info("deleting snapshot of match %s in state %d, saved %v ago", snapshot.MatchId, snapshot.GameState, age.Round(time.Second))
+				deleteSnapshot(ctx, logger, nk, object.GetKey())
+				continue
+			}
+
+			claimed := snapshot
+			claimed.SavedAt = time.Now().Unix()
+			bytes, _ := json.Marshal(claimed)
+			if _, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{{
+				Collection:      snapshotCollection,
+				Key:             object.GetKey(),
+				UserID:          systemUserId,
+				Value:           string(bytes),
+				Version:         object.GetVersion(),
+				PermissionRead:  runtime.STORAGE_PERMISSION_NO_READ,
+				PermissionWrite: runtime.STORAGE_PERMISSION_NO_WRITE,
+			}}); err != nil {
+				logger.Info("snapshot of match %s was claimed elsewhere: %v", snapshot.MatchId, err)
+				continue
+			}
+
+			matchId, err := nk.MatchCreate(ctx, "LobbyMatch", map[string]interface{}{"recovered": claimed})
+			if err != nil {
+				logger.Error("unable to recover match %s: %v", snapshot.MatchId, err)
+				continue
+			}
+			logger.Info("recovered match %s as %s", snapshot.MatchId, matchId)
+		}
+
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/api"
+	"github.com/heroiclabs/nakama-common/runtime"
+
+	"imps/mpserver/nakamatest"
+	"imps/mpserver/protocol"
+)
+
+// launchedLobby starts a two player lobby and launches its game.
+func launchedLobby(t *testing.T) (*lobbyHarness, *nakamatest.Presence, *nakamatest.Presence) {
+	h := newLobbyHarness(t, nil)
+	h.init("host", protocol.LobbySettings{})
+	host := h.nk.AddUser("host", "Host")
+	guest := h.nk.AddUser("guest", "Guest")
+	h.join(host, deltaClient)
+	h.join(guest, deltaClient)
+	h.loop(message(host, protocol.OP_READY, protocol.Ready{}), message(guest, protocol.OP_READY, protocol.Ready{}))
+	if h.lobby().GameState != InProgress {
+		t.Fatalf("lobby didn't launch, state %v", h.lobby().GameState)
+	}
+	return h, host, guest
+}
+
+func snapshotKeys(nk *nakamatest.NakamaModule) []string {
+	keys := make([]string, 0)
+	for _, o := range nk.Storage {
+		if o.Collection == snapshotCollection {
+			keys = append(keys, o.Key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestSnapshotRecovery(t *testing.T) {
+	h, host, _ := launchedLobby(t)
+	// Someone watching the game, who is in the next snapshot
+	h.lobby().AllowedObservers = 1
+	watcher := h.nk.AddUser("watcher", "Watcher")
+	if accepted, reason := h.join(watcher, deltaClient); !accepted {
+		t.Fatalf("watcher was turned away: %s", reason)
+	}
+	saveSnapshot(h.ctx, h.logger, h.nk, h.lobby())
+	launched := h.lobby()
+	if keys := snapshotKeys(h.nk); len(keys) != 1 || keys[0] != "lobby.node" {
+		t.Fatalf("snapshots after launch = %v", keys)
+	}
+
+	// The node restarts: the lobby is gone, and startup recovers it
+	if err := recoverLobbies(h.ctx, h.logger, h.nk, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if len(h.nk.Created) != 1 || h.nk.Created[0].Module != "LobbyMatch" {
+		t.Fatalf("created matches = %+v", h.nk.Created)
+	}
+
+	h.ctx = context.WithValue(context.Background(), runtime.RUNTIME_CTX_MATCH_ID, h.nk.Created[0].MatchId)
+	h.match = &LobbyMatch{config: h.config, allocator: newServerAllocator(h.config.ServerManagers), queue: newAllocationQueue(), metrics: newLobbyMetrics(h.nk), analytics: newLobbyAnalytics(h.nk)}
+	h.dispatcher.Reset()
+	h.tick = 0
+	state, _, label := h.match.MatchInit(h.ctx, h.logger, nil, h.nk, h.nk.Created[0].Params)
+	if state == nil {
+		t.Fatalf("recovered lobby refused its params")
+	}
+	h.state = state
+	h.check("MatchInit")
+
+	recovered := h.lobby()
+	if recovered.GameState != InProgress || recovered.ServerId != launched.ServerId || recovered.HostUserId != "host" || recovered.PlayerCount != 0 {
+		t.Errorf("recovered lobby = %+v", recovered)
+	}
+	if got := resolveMatchId(h.ctx, h.logger, h.nk, "lobby.node"); got != "match-1.node" {
+		t.Errorf("game server's match ID resolves to %s", got)
+	}
+	if label == "" {
+		t.Errorf("recovered lobby has no label")
+	}
+
+	// Nobody is back yet, but the lobby waits for them longer than usual
+	for i := int64(0); i <= h.config.ticks(h.config.EmptyTimeout)+1; i++ {
+		h.loop()
+	}
+	if h.state == nil {
+		t.Fatalf("recovered lobby ended before its players could reconnect")
+	}
+
+	// The host's client only knows the match ID it joined before the restart
+	clientCtx := context.WithValue(context.Background(), runtime.RUNTIME_CTX_USER_ID, host.UserId)
+	response, err := resolveMatch(clientCtx, h.logger, nil, h.nk, `{"matchId":"lobby.node"}`)
+	if err != nil {
+		t.Fatalf("resolve-match: %v", err)
+	}
+	var resolved struct{ MatchId string }
+	if err := json.Unmarshal([]byte(response), &resolved); err != nil || resolved.MatchId != recovered.MatchId {
+		t.Fatalf("resolve-match answered %s, want %s", response, recovered.MatchId)
+	}
+
+	// Knowing the match ID isn't enough to get the game server
+	if accepted, reason := h.join(h.nk.AddUser("stranger", "Stranger"), deltaClient); accepted || reason != "Not in this game" {
+		t.Fatalf("stranger joining the recovered lobby: accepted %v, %q", accepted, reason)
+	}
+	if starts := received[protocol.GameStart](h, &nakamatest.Presence{SessionId: "session-stranger"}, protocol.OP_GAME_START); len(starts) != 0 {
+		t.Errorf("stranger was sent game starts %+v", starts)
+	}
+
+	// The watcher is back first but still only watches
+	h.join(&nakamatest.Presence{UserId: watcher.UserId, SessionId: "session-watcher-2", Username: watcher.Username}, deltaClient)
+	if accepted, reason := h.join(&nakamatest.Presence{UserId: host.UserId, SessionId: "session-host-2", Username: host.Username}, deltaClient); !accepted {
+		t.Fatalf("rejoining host was turned away: %s", reason)
+	}
+	if p := h.lobby().Players["session-watcher-2"]; !p.IsObserving {
+		t.Errorf("watcher rejoined as a player")
+	}
+	if p := h.lobby().Players["session-host-2"]; p.IsObserving {
+		t.Errorf("host rejoined as an observer")
+	}
+
+	// The guest hasn't rejoined yet, but can still after the next snapshot
+	saveSnapshot(h.ctx, h.logger, h.nk, h.lobby())
+	snapshot, err := readSnapshot(h.ctx, h.nk, "lobby.node")
+	if err != nil || snapshot == nil {
+		t.Fatalf("snapshot = %+v, %v", snapshot, err)
+	}
+	want := []savedParticipant{{UserId: "guest"}, {UserId: "host"}, {UserId: "watcher", IsObserving: true}}
+	if !reflect.DeepEqual(snapshot.Participants, want) {
+		t.Errorf("participants = %+v, want %+v", snapshot.Participants, want)
+	}
+	starts := received[protocol.GameStart](h, &nakamatest.Presence{SessionId: "session-host-2"}, protocol.OP_GAME_START)
+	if len(starts) != 1 || string(starts[0].Server) != strings.TrimSpace(string(launched.ServerResponse)) {
+		t.Errorf("rejoining host was sent game starts %+v", starts)
+	}
+}
+
+func TestSnapshotDeletedWhenLobbyEnds(t *testing.T) {
+	h, _, _ := launchedLobby(t)
+
+	h.signal(signalGameEnded)
+	h.loop()
+	if h.state != nil {
+		t.Fatalf("lobby didn't end")
+	}
+	if keys := snapshotKeys(h.nk); len(keys) != 0 {
+		t.Errorf("snapshots left after the lobby ended: %v", keys)
+	}
+}
+
+func TestRecoverLobbies(t *testing.T) {
+	saved := func(state GameState, age time.Duration) string {
+		bytes, _ := json.Marshal(savedLobby{
+			Version:             snapshotVersion,
+			SavedAt:             time.Now().Add(-age).Unix(),
+			MatchId:             "old.node",
+			OriginalMatchId:     "old.node",
+			RequiredPlayerCount: 2,
+			GameState:           state,
+			ServerBackend:       "http://servermanager:5000",
+			Participants:        []savedParticipant{{UserId: "host"}},
+		})
+		return string(bytes)
+	}
+
+	tests := []struct {
+		name        string
+		value       string
+		running     bool
+		wantCreated int
+		wantKept    bool
+	}{
+		{name: "game in progress", value: saved(InProgress, time.Minute), wantCreated: 1, wantKept: true},
+		{name: "lobby still running", value: saved(InProgress, time.Minute), running: true, wantKept: true},
+		{name: "lobby never launched", value: saved(WaitingForPlayersReady, time.Minute)},
+		{name: "too old", value: saved(InProgress, 2*time.Hour)},
+		{name: "unreadable", value: "{"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nk := nakamatest.NewNakamaModule()
+			nk.StorageWrite(context.Background(), []*runtime.StorageWrite{{
+				Collection: snapshotCollection,
+				Key:        "old.node",
+				UserID:     systemUserId,
+				Value:      tt.value,
+			}})
+			if tt.running {
+				nk.Matches = append(nk.Matches, &api.Match{MatchId: "old.node"})
+			}
+
+			if err := recoverLobbies(context.Background(), nakamatest.NewLogger(t), nk, time.Hour); err != nil {
+				t.Fatal(err)
+			}
+			if len(nk.Created) != tt.wantCreated {
+				t.Errorf("created %d lobbies, want %d", len(nk.Created), tt.wantCreated)
+			}
+			if kept := len(snapshotKeys(nk)) == 1; kept != tt.wantKept {
+				t.Errorf("snapshot kept = %v, want %v", kept, tt.wantKept)
+			}
+		})
+	}
+}
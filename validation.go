@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+
+	"imps/mpserver/protocol"
+)
+
+const codeInvalidArgument = 3 // INVALID_ARGUMENT
+
+// fieldErrors collects everything wrong with a payload, one "field: problem"
+// entry per issue, so clients can fix them all in one go.
+type fieldErrors []string
+
+func (f *fieldErrors) add(field string, format string, args ...interface{}) {
+	*f = append(*f, field+": "+fmt.Sprintf(format, args...))
+}
+
+// payloadValidator is implemented by rpc requests and params that need more
+// than type checking. validate is called after the payload has been decoded
+// and checks everything the types can't, like lengths and allowed values.
+type payloadValidator interface {
+	validate(errs *fieldErrors)
+}
+
+type validationError struct {
+	fields fieldErrors
+}
+
+func (e *validationError) Error() string {
+	return "invalid payload: " + strings.Join(e.fields, "; ")
+}
+
+// decodePayload strictly decodes a JSON payload into v and validates it if v
+// is a payloadValidator. An empty payload decodes as an empty object, so
+// requests with nothing but optional fields can be sent without one.
+func decodePayload(data []byte, v interface{}) error {
+	if len(bytes.TrimSpace(data)) == 0 {
+		data = []byte("{}")
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return decodeError(err)
+	}
+	if decoder.More() {
+		return &validationError{fieldErrors{"payload: must be a single JSON object"}}
+	}
+
+	if validator, ok := v.(payloadValidator); ok {
+		var errs fieldErrors
+		validator.validate(&errs)
+		if len(errs) > 0 {
+			return &validationError{errs}
+		}
+	}
+	return nil
+}
+
+// decodeMessage decodes an opcode payload in the encoding the sender joined
+// with. Protobuf payloads get the same strictness as JSON ones.
+func decodeMessage(player *PlayerState, data []byte, v interface{}) error {
+	if player.Encoding != protocol.EncodingProtobuf {
+		return decodePayload(data, v)
+	}
+
+	if err := protocol.UnmarshalProto(data, v); err != nil {
+		return &validationError{fieldErrors{"payload: " + err.Error()}}
+	}
+	if validator, ok := v.(payloadValidator); ok {
+		var errs fieldErrors
+		validator.validate(&errs)
+		if len(errs) > 0 {
+			return &validationError{errs}
+		}
+	}
+	return nil
+}
+
+// decodeParams validates match params the same way as a payload, since they
+// are just as untrusted by the time they reach MatchInit.
+func decodeParams(params map[string]interface{}, v payloadValidator) error {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	return decodePayload(data, v)
+}
+
+func decodeError(err error) error {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		field := typeErr.Field
+		if field == "" {
+			field = "payload"
+		}
+		return &validationError{fieldErrors{fmt.Sprintf("%s: must be %s", field, jsonTypeName(typeErr.Type))}}
+	}
+
+	// encoding/json has no typed error for unknown fields
+	if unknown := strings.TrimPrefix(err.Error(), "json: unknown field "); unknown != err.Error() {
+		return &validationError{fieldErrors{fmt.Sprintf("%s: unknown field", strings.Trim(unknown, `"`))}}
+	}
+
+	return &validationError{fieldErrors{"payload: must be a JSON object"}}
+}
+
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.String:
+		return "a string"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	default:
+		return "an object"
+	}
+}
+
+// invalidArgument turns a decoding or validation error into the runtime error
+// rpcs return to clients.
+func invalidArgument(err error) error {
+	return runtime.NewError(err.Error(), codeInvalidArgument)
+}